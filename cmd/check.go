@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/girish332/bigdata/database"
+	"github.com/girish332/bigdata/elastic"
+	"github.com/girish332/bigdata/indexer"
+	"github.com/girish332/bigdata/service"
+	"io"
+)
+
+// ErrInconsistent is returned by check when drift was found and not repaired
+var ErrInconsistent = errors.New("redis and the search index are inconsistent")
+
+// Check compares the plans in Redis with the plans index and prints the drift.
+// With -repair the drift is repaired right away.
+func Check(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	flags.SetOutput(out)
+	repair := flags.Bool("repair", false, "reindex plans with missing or stale documents and delete orphaned documents")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+
+	es, err := newElasticClient()
+	if err != nil {
+		return err
+	}
+	ix := indexer.New(es, elastic.PlansAlias, indexer.DefaultConfig())
+	defer ix.Close()
+	repo := database.NewRedisRepo("localhost:6379", "")
+	// Plans stored before the plan index existed would be skipped otherwise
+	if err := service.BackfillPlanIndex(ctx, repo); err != nil {
+		return err
+	}
+	consistencyService := service.NewConsistencyService(repo, ix)
+
+	report, err := consistencyService.Check(ctx, *repair)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+
+	if !report.Consistent() && (!report.Repaired || len(report.RepairErrors) > 0) {
+		return ErrInconsistent
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/girish332/bigdata/elastic"
+	"io"
+)
+
+// Usage lists the subcommands of the bigdata binary
+const Usage = `usage: bigdata [command]
+
+commands:
+  serve                  run the REST API on :8080 (default)
+  index create           create plans_v1 behind the plans alias
+  index status           show the index behind the plans alias and whether its mapping is current
+  index migrate [-force] copy the plans alias to a new index with the current mapping and swap the alias
+  reindex [-batch N] [-rate N] [-resume]
+                         index every plan stored in Redis into the plans alias
+  check [-repair]        compare the plans in Redis with the plans alias and optionally repair the drift
+`
+
+// ErrUsage is returned for unknown commands or arguments
+var ErrUsage = errors.New("invalid arguments")
+
+func newElasticClient() (*elasticsearch.Client, error) {
+	client, err := elastic.NewElasticFactory().NewClient(elasticsearch.Config{
+		Addresses: []string{
+			"http://localhost:9200",
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return client.ES, nil
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprint(w, Usage)
+}
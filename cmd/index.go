@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/girish332/bigdata/elastic"
+	"io"
+	"log"
+)
+
+// Index runs the index subcommands managing the versioned indices behind the
+// plans alias
+func Index(ctx context.Context, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		printUsage(out)
+		return ErrUsage
+	}
+
+	es, err := newElasticClient()
+	if err != nil {
+		return err
+	}
+	manager := elastic.NewIndexManager(es, elastic.PlansAlias, elastic.Mapping())
+
+	switch args[0] {
+	case "create":
+		index, err := manager.Create(ctx)
+		if errors.Is(err, elastic.ErrAliasExists) {
+			log.Printf("Alias %s already exists, run index migrate to apply a new mapping", elastic.PlansAlias)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Created %s behind alias %s", index, elastic.PlansAlias)
+		return nil
+	case "status":
+		status, err := manager.Status(ctx)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(status)
+	case "migrate":
+		force := len(args) > 1 && args[1] == "-force"
+		index, err := manager.Migrate(ctx, force)
+		if errors.Is(err, elastic.ErrUpToDate) {
+			log.Printf("Mapping of alias %s is up to date, use -force to migrate anyway", elastic.PlansAlias)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Alias %s migrated to %s", elastic.PlansAlias, index)
+		return nil
+	default:
+		printUsage(out)
+		return ErrUsage
+	}
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"github.com/girish332/bigdata/database"
+	"github.com/girish332/bigdata/elastic"
+	"github.com/girish332/bigdata/indexer"
+	"github.com/girish332/bigdata/service"
+	"io"
+	"os/signal"
+	"syscall"
+)
+
+// Reindex rebuilds the plans index from the plans stored in Redis. Interrupting
+// it stops after the current batch, and -resume continues where it stopped.
+func Reindex(ctx context.Context, args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("reindex", flag.ContinueOnError)
+	flags.SetOutput(out)
+	batch := flags.Int64("batch", 100, "plans read from Redis and indexed at a time")
+	rate := flags.Int("rate", 0, "maximum plans indexed per second, 0 for no limit")
+	resume := flags.Bool("resume", false, "continue after the last plan of an unfinished reindex")
+	if err := flags.Parse(args); err != nil {
+		return ErrUsage
+	}
+
+	es, err := newElasticClient()
+	if err != nil {
+		return err
+	}
+	ix := indexer.New(es, elastic.PlansAlias, indexer.DefaultConfig())
+	defer ix.Close()
+	repo := database.NewRedisRepo("localhost:6379", "")
+	// Plans stored before the plan index existed would be skipped otherwise
+	if err := service.BackfillPlanIndex(ctx, repo); err != nil {
+		return err
+	}
+	reindexService := service.NewReindexService(repo, ix)
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	state, err := reindexService.Run(ctx, service.ReindexOptions{
+		BatchSize: *batch,
+		Rate:      *rate,
+		Resume:    *resume,
+	})
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if encErr := enc.Encode(state); encErr != nil {
+		return encErr
+	}
+	return err
+}
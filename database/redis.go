@@ -1,12 +1,15 @@
 package database
 
 import (
+	"context"
 	"errors"
-	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/repository"
 	goredis "github.com/redis/go-redis/v9"
 	"time"
 )
 
+const keyTTL = 5 * time.Hour
+
 type RedisRepo struct {
 	client goredis.Client
 }
@@ -20,23 +23,35 @@ func NewRedisRepo(address, password string) *RedisRepo {
 	}
 }
 
-func (repo *RedisRepo) Get(ctx *gin.Context, key string) (string, error) {
+func (repo *RedisRepo) Get(ctx context.Context, key string) (string, error) {
 	val, err := repo.client.Get(ctx, key).Result()
+	if errors.Is(err, goredis.Nil) {
+		return "", repository.ErrKeyNotFound
+	}
 	if err != nil {
 		return "", err
 	}
 	return val, nil
 }
 
-func (repo *RedisRepo) Set(ctx *gin.Context, key, value string) error {
-	_, err := repo.client.Set(ctx, key, value, 5*time.Hour).Result()
+func (repo *RedisRepo) Set(ctx context.Context, key, value string) error {
+	_, err := repo.client.Set(ctx, key, value, keyTTL).Result()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetPersistent stores a value without the expiry applied to plan objects
+func (repo *RedisRepo) SetPersistent(ctx context.Context, key, value string) error {
+	_, err := repo.client.Set(ctx, key, value, 0).Result()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (repo *RedisRepo) Ping(ctx *gin.Context) error {
+func (repo *RedisRepo) Ping(ctx context.Context) error {
 	_, err := repo.client.Ping(ctx).Result()
 	if err != nil {
 		return err
@@ -44,21 +59,187 @@ func (repo *RedisRepo) Ping(ctx *gin.Context) error {
 	return nil
 }
 
-func (repo *RedisRepo) Delete(ctx *gin.Context, key string) error {
+func (repo *RedisRepo) Delete(ctx context.Context, key string) error {
 	res, err := repo.client.Del(ctx, key).Result()
 	if err != nil {
 		return err
 	}
 	if res == 0 {
-		return errors.New("key not found")
+		return repository.ErrKeyNotFound
 	}
 	return nil
 }
 
-func (repo *RedisRepo) Keys(c *gin.Context, pattern string) ([]string, error) {
+func (repo *RedisRepo) Keys(c context.Context, pattern string) ([]string, error) {
 	keys, err := repo.client.Keys(c, pattern).Result()
 	if err != nil {
 		return nil, err
 	}
 	return keys, nil
 }
+
+func (repo *RedisRepo) Scan(c context.Context, cursor uint64, count int64) ([]string, uint64, error) {
+	keys, next, err := repo.client.Scan(c, cursor, "", count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	return keys, next, nil
+}
+
+func (repo *RedisRepo) MGet(c context.Context, keys ...string) ([]string, error) {
+	if len(keys) == 0 {
+		return []string{}, nil
+	}
+	vals, err := repo.client.MGet(c, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	values := make([]string, len(vals))
+	for i, val := range vals {
+		// Missing keys come back as nil, keep them as empty strings
+		if s, ok := val.(string); ok {
+			values[i] = s
+		}
+	}
+	return values, nil
+}
+
+func (repo *RedisRepo) ZAdd(c context.Context, key, member string) error {
+	_, err := repo.client.ZAdd(c, key, goredis.Z{Member: member}).Result()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *RedisRepo) ZRem(c context.Context, key, member string) error {
+	_, err := repo.client.ZRem(c, key, member).Result()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ZRangeAfter returns up to count members of a zero scored sorted set that sort
+// lexicographically after the given member. An empty after starts from the beginning.
+func (repo *RedisRepo) ZRangeAfter(c context.Context, key, after string, count int64) ([]string, error) {
+	min := "-"
+	if after != "" {
+		min = "(" + after
+	}
+	members, err := repo.client.ZRangeByLex(c, key, &goredis.ZRangeBy{
+		Min:   min,
+		Max:   "+",
+		Count: count,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (repo *RedisRepo) ZCard(c context.Context, key string) (int64, error) {
+	count, err := repo.client.ZCard(c, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (repo *RedisRepo) LRange(c context.Context, key string, start, stop int64) ([]string, error) {
+	values, err := repo.client.LRange(c, key, start, stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// LRem removes up to count occurrences of value from the list, starting at the head
+func (repo *RedisRepo) LRem(c context.Context, key string, count int64, value string) error {
+	_, err := repo.client.LRem(c, key, count, value).Result()
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (repo *RedisRepo) Tx(c context.Context, watch []string, fn func(tx repository.RedisTx) error) error {
+	err := repo.client.Watch(c, func(tx *goredis.Tx) error {
+		rtx := &redisTx{ctx: c, tx: tx}
+		if err := fn(rtx); err != nil {
+			return err
+		}
+		if len(rtx.queued) == 0 {
+			return nil
+		}
+
+		_, err := tx.TxPipelined(c, func(pipe goredis.Pipeliner) error {
+			for _, op := range rtx.queued {
+				op(pipe)
+			}
+			return nil
+		})
+		return err
+	}, watch...)
+	if errors.Is(err, goredis.TxFailedErr) {
+		return repository.ErrTxConflict
+	}
+	return err
+}
+
+type redisTx struct {
+	ctx    context.Context
+	tx     *goredis.Tx
+	queued []func(pipe goredis.Pipeliner)
+}
+
+func (t *redisTx) Watch(keys ...string) error {
+	return t.tx.Watch(t.ctx, keys...).Err()
+}
+
+func (t *redisTx) Get(key string) (string, error) {
+	val, err := t.tx.Get(t.ctx, key).Result()
+	if errors.Is(err, goredis.Nil) {
+		return "", repository.ErrKeyNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+func (t *redisTx) Set(key, value string) {
+	t.queued = append(t.queued, func(pipe goredis.Pipeliner) {
+		pipe.Set(t.ctx, key, value, keyTTL)
+	})
+}
+
+func (t *redisTx) SetPersistent(key, value string) {
+	t.queued = append(t.queued, func(pipe goredis.Pipeliner) {
+		pipe.Set(t.ctx, key, value, 0)
+	})
+}
+
+func (t *redisTx) Delete(key string) {
+	t.queued = append(t.queued, func(pipe goredis.Pipeliner) {
+		pipe.Del(t.ctx, key)
+	})
+}
+
+func (t *redisTx) ZAdd(key, member string) {
+	t.queued = append(t.queued, func(pipe goredis.Pipeliner) {
+		pipe.ZAdd(t.ctx, key, goredis.Z{Member: member})
+	})
+}
+
+func (t *redisTx) ZRem(key, member string) {
+	t.queued = append(t.queued, func(pipe goredis.Pipeliner) {
+		pipe.ZRem(t.ctx, key, member)
+	})
+}
+
+func (t *redisTx) RPush(key, value string) {
+	t.queued = append(t.queued, func(pipe goredis.Pipeliner) {
+		pipe.RPush(t.ctx, key, value)
+	})
+}
@@ -1,10 +1,39 @@
 package elastic
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"io"
 	"log"
+	"net/http"
 )
 
+// ResponseError is an error response of Elasticsearch
+type ResponseError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("[%d %s] %s", e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// DecodeResponse closes the response after decoding a successful one into out,
+// if given. An error response is returned as a *ResponseError.
+func DecodeResponse(res *esapi.Response, out interface{}) error {
+	defer res.Body.Close()
+	if res.IsError() {
+		body, _ := io.ReadAll(res.Body)
+		return &ResponseError{StatusCode: res.StatusCode, Body: string(body)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
 type Client struct {
 	ES *elasticsearch.Client
 }
@@ -0,0 +1,50 @@
+package elastic
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// closeRecorder reports whether the body of a response was closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDecodeResponse(t *testing.T) {
+	body := &closeRecorder{Reader: strings.NewReader(`{"count": 3}`)}
+	var out struct {
+		Count int `json:"count"`
+	}
+	if err := DecodeResponse(&esapi.Response{StatusCode: http.StatusOK, Body: body}, &out); err != nil || out.Count != 3 {
+		t.Errorf("DecodeResponse() = %+v, %v, want a count of 3", out, err)
+	}
+	if !body.closed {
+		t.Error("body of a successful response was not closed")
+	}
+
+	body = &closeRecorder{Reader: strings.NewReader(`{"error": {"type": "cluster_block_exception"}}`)}
+	err := DecodeResponse(&esapi.Response{StatusCode: http.StatusForbidden, Body: body}, &out)
+	var resErr *ResponseError
+	if !errors.As(err, &resErr) || resErr.StatusCode != http.StatusForbidden || !strings.Contains(resErr.Body, "cluster_block_exception") {
+		t.Errorf("DecodeResponse() error = %v, want a ResponseError with the status and body", err)
+	}
+	if !body.closed {
+		t.Error("body of an error response was not closed")
+	}
+
+	body = &closeRecorder{Reader: strings.NewReader(`{"acknowledged": true}`)}
+	if err := DecodeResponse(&esapi.Response{StatusCode: http.StatusOK, Body: body}, nil); err != nil || !body.closed {
+		t.Errorf("DecodeResponse() without out = %v, closed %t, want nil and the body closed", err, body.closed)
+	}
+}
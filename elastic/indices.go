@@ -0,0 +1,353 @@
+package elastic
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PlansAlias is the alias searched and written by the API and the listener. It
+// points at exactly one versioned index, plans_v1, plans_v2 and so on.
+const PlansAlias = "plans"
+
+// mappingHashKey is the _meta entry recording which mapping an index was created with
+const mappingHashKey = "mapping_hash"
+
+var (
+	ErrAliasExists = errors.New("index alias already exists")
+	ErrNoIndex     = errors.New("index alias does not exist")
+	ErrUpToDate    = errors.New("index mapping is up to date")
+)
+
+func isNotFound(err error) bool {
+	var resErr *ResponseError
+	return errors.As(err, &resErr) && resErr.StatusCode == http.StatusNotFound
+}
+
+// IndexStatus describes the index currently behind an alias
+type IndexStatus struct {
+	Alias string `json:"alias"`
+	Index string `json:"index"`
+	// Version is the N of the alias_vN index, 0 for a plain index named like the alias
+	Version     int    `json:"version"`
+	Documents   int64  `json:"documents"`
+	MappingHash string `json:"mappingHash"`
+	// UpToDate reports whether the index was created with the current mapping
+	UpToDate bool `json:"upToDate"`
+}
+
+// IndexManager creates the versioned indices behind an alias and migrates the
+// alias to a new index when the mapping changes
+type IndexManager struct {
+	es      *elasticsearch.Client
+	alias   string
+	mapping map[string]interface{}
+}
+
+func NewIndexManager(es *elasticsearch.Client, alias string, mapping map[string]interface{}) *IndexManager {
+	return &IndexManager{
+		es:      es,
+		alias:   alias,
+		mapping: mapping,
+	}
+}
+
+// MappingHash identifies a mapping. encoding/json sorts map keys, so equal
+// mappings always hash the same.
+func MappingHash(mapping map[string]interface{}) (string, error) {
+	raw, err := json.Marshal(mapping)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Create creates the first versioned index with the current mapping and points
+// the alias at it. It fails with ErrAliasExists once the alias or an index of the
+// same name exists; use Migrate to move it to a new mapping.
+func (m *IndexManager) Create(ctx context.Context) (string, error) {
+	_, err := m.current(ctx)
+	if err == nil {
+		return "", ErrAliasExists
+	}
+	if !errors.Is(err, ErrNoIndex) {
+		return "", err
+	}
+
+	index := m.versionedName(1)
+	err = m.createIndex(ctx, index, true)
+	if err != nil {
+		return "", err
+	}
+	return index, nil
+}
+
+// Status reports the index behind the alias and whether its mapping is current
+func (m *IndexManager) Status(ctx context.Context) (IndexStatus, error) {
+	index, err := m.current(ctx)
+	if err != nil {
+		return IndexStatus{}, err
+	}
+
+	hash, err := m.indexMappingHash(ctx, index)
+	if err != nil {
+		return IndexStatus{}, err
+	}
+	current, err := MappingHash(m.mapping)
+	if err != nil {
+		return IndexStatus{}, err
+	}
+
+	var count struct {
+		Count int64 `json:"count"`
+	}
+	err = m.do(ctx, esapi.CountRequest{Index: []string{index}}, &count)
+	if err != nil {
+		return IndexStatus{}, err
+	}
+
+	return IndexStatus{
+		Alias:       m.alias,
+		Index:       index,
+		Version:     m.version(index),
+		Documents:   count.Count,
+		MappingHash: hash,
+		UpToDate:    hash == current,
+	}, nil
+}
+
+// Migrate moves the alias to a new versioned index created with the current
+// mapping. The old index is write blocked while its documents are copied with
+// their external versions and the alias is swapped atomically, so searches never
+// see an empty or missing index and no write or delete made during the copy is
+// lost. Writes rejected by the block are retried by the indexer, however long the
+// copy takes, until they reach the new index through the alias.
+// Unless force is set it fails with ErrUpToDate when the mapping did not change.
+// The old index is kept so a migration can be rolled back by hand, except for a
+// plain index named like the alias, which has to make way for the alias.
+func (m *IndexManager) Migrate(ctx context.Context, force bool) (string, error) {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return "", err
+	}
+	if status.UpToDate && !force {
+		return "", ErrUpToDate
+	}
+
+	next := m.versionedName(status.Version + 1)
+	log.Printf("Migrating alias %s from %s to %s", m.alias, status.Index, next)
+	err = m.createIndex(ctx, next, false)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.blockWrites(ctx, status.Index, true)
+	if err != nil {
+		return "", err
+	}
+	swapped := false
+	defer func() {
+		if swapped && status.Index == m.alias {
+			// The old plain index was dropped by the swap
+			return
+		}
+		if err := m.blockWrites(context.Background(), status.Index, false); err != nil {
+			log.Printf("Failed to lift the write block of %s: %v", status.Index, err)
+		}
+	}()
+
+	err = m.reindex(ctx, status.Index, next)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.swap(ctx, status.Index, next)
+	if err != nil {
+		return "", err
+	}
+	swapped = true
+	return next, nil
+}
+
+// blockWrites sets or lifts the write block of an index. Reads keep working while
+// writes are rejected with a cluster_block_exception.
+func (m *IndexManager) blockWrites(ctx context.Context, index string, block bool) error {
+	body, err := json.Marshal(map[string]interface{}{"index.blocks.write": block})
+	if err != nil {
+		return err
+	}
+	err = m.do(ctx, esapi.IndicesPutSettingsRequest{Index: []string{index}, Body: bytes.NewReader(body)}, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Write block of %s set to %t", index, block)
+	return nil
+}
+
+// current returns the index the alias points at. A concrete index that has the
+// name of the alias, as created before versioned indices, is returned as is.
+func (m *IndexManager) current(ctx context.Context) (string, error) {
+	aliases := map[string]interface{}{}
+	err := m.do(ctx, esapi.IndicesGetAliasRequest{Name: []string{m.alias}}, &aliases)
+	if err == nil && len(aliases) > 0 {
+		indices := make([]string, 0, len(aliases))
+		for index := range aliases {
+			indices = append(indices, index)
+		}
+		if len(indices) > 1 {
+			sort.Strings(indices)
+			return "", fmt.Errorf("alias %s points at more than one index: %s", m.alias, strings.Join(indices, ", "))
+		}
+		return indices[0], nil
+	}
+	if err != nil && !isNotFound(err) {
+		return "", err
+	}
+
+	err = m.do(ctx, esapi.IndicesExistsRequest{Index: []string{m.alias}}, nil)
+	if isNotFound(err) {
+		return "", ErrNoIndex
+	}
+	if err != nil {
+		return "", err
+	}
+	return m.alias, nil
+}
+
+// createIndex creates an index with the current mapping, recording the hash of the
+// mapping in its _meta, and optionally points the alias at it right away
+func (m *IndexManager) createIndex(ctx context.Context, index string, withAlias bool) error {
+	hash, err := MappingHash(m.mapping)
+	if err != nil {
+		return err
+	}
+
+	mapping := map[string]interface{}{}
+	for key, value := range m.mapping {
+		mapping[key] = value
+	}
+	mapping["_meta"] = map[string]interface{}{mappingHashKey: hash}
+
+	body := map[string]interface{}{"mappings": mapping}
+	if withAlias {
+		body["aliases"] = map[string]interface{}{
+			m.alias: map[string]interface{}{"is_write_index": true},
+		}
+	}
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	err = m.do(ctx, esapi.IndicesCreateRequest{Index: index, Body: bytes.NewReader(raw)}, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Created index %s with mapping %s", index, hash)
+	return nil
+}
+
+// reindex copies every document from one index to another, keeping the external
+// versions and skipping documents the destination already has in a newer version
+func (m *IndexManager) reindex(ctx context.Context, from, to string) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"conflicts": "proceed",
+		"source":    map[string]interface{}{"index": from},
+		"dest":      map[string]interface{}{"index": to, "version_type": "external"},
+	})
+	if err != nil {
+		return err
+	}
+
+	wait := true
+	var result struct {
+		Total   int64             `json:"total"`
+		Created int64             `json:"created"`
+		Updated int64             `json:"updated"`
+		Skipped int64             `json:"version_conflicts"`
+		Failed  []json.RawMessage `json:"failures"`
+	}
+	err = m.do(ctx, esapi.ReindexRequest{Body: bytes.NewReader(body), WaitForCompletion: &wait}, &result)
+	if err != nil {
+		return err
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf("%d documents failed to copy from %s to %s: %s", len(result.Failed), from, to, result.Failed[0])
+	}
+	log.Printf("Copied %s to %s: %d documents, %d created, %d updated, %d already newer", from, to, result.Total, result.Created, result.Updated, result.Skipped)
+	return nil
+}
+
+// swap points the alias at the new index in a single atomic _aliases call. A
+// concrete index named like the alias is removed in the same call, otherwise the
+// alias could not take over its name.
+func (m *IndexManager) swap(ctx context.Context, from, to string) error {
+	actions := make([]map[string]interface{}, 0, 2)
+	if from == m.alias {
+		actions = append(actions, map[string]interface{}{"remove_index": map[string]interface{}{"index": from}})
+	} else {
+		actions = append(actions, map[string]interface{}{"remove": map[string]interface{}{"index": from, "alias": m.alias}})
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]interface{}{"index": to, "alias": m.alias, "is_write_index": true}})
+
+	body, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return err
+	}
+	err = m.do(ctx, esapi.IndicesUpdateAliasesRequest{Body: bytes.NewReader(body)}, nil)
+	if err != nil {
+		return err
+	}
+	log.Printf("Alias %s now points at %s", m.alias, to)
+	return nil
+}
+
+// indexMappingHash returns the mapping hash recorded in the _meta of an index,
+// or an empty string for indices created without one
+func (m *IndexManager) indexMappingHash(ctx context.Context, index string) (string, error) {
+	mappings := map[string]struct {
+		Mappings struct {
+			Meta map[string]interface{} `json:"_meta"`
+		} `json:"mappings"`
+	}{}
+	err := m.do(ctx, esapi.IndicesGetMappingRequest{Index: []string{index}}, &mappings)
+	if err != nil {
+		return "", err
+	}
+	hash, _ := mappings[index].Mappings.Meta[mappingHashKey].(string)
+	return hash, nil
+}
+
+func (m *IndexManager) versionedName(version int) string {
+	return m.alias + "_v" + strconv.Itoa(version)
+}
+
+// version returns the N of an alias_vN index, or 0 for any other index
+func (m *IndexManager) version(index string) int {
+	version, err := strconv.Atoi(strings.TrimPrefix(index, m.alias+"_v"))
+	if err != nil || !strings.HasPrefix(index, m.alias+"_v") {
+		return 0
+	}
+	return version
+}
+
+// do sends the request and decodes a successful response into out, if given
+func (m *IndexManager) do(ctx context.Context, req esapi.Request, out interface{}) error {
+	res, err := req.Do(ctx, m.es)
+	if err != nil {
+		return err
+	}
+	return DecodeResponse(res, out)
+}
@@ -0,0 +1,269 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// fakeIndex is an index of the fakeCluster
+type fakeIndex struct {
+	hash      string
+	documents int64
+	alias     bool
+	blocked   bool
+}
+
+// fakeCluster is an Elasticsearch stand in serving the index, alias, settings,
+// count and _reindex calls of the IndexManager. Every request is recorded as
+// "METHOD path", and a status in fail answers the request of that key instead.
+type fakeCluster struct {
+	mu       sync.Mutex
+	alias    string
+	indices  map[string]*fakeIndex
+	requests []string
+	fail     map[string]int
+	// copied records the write block of the source of every _reindex
+	copied []bool
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	key := r.Method + " " + r.URL.Path
+	f.requests = append(f.requests, key)
+	if status, ok := f.fail[key]; ok {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error": "injected failure"}`))
+		return
+	}
+
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	index := f.indices[parts[0]]
+
+	switch {
+	case r.Method == http.MethodGet && parts[0] == "_alias":
+		aliases := map[string]interface{}{}
+		for name, ix := range f.indices {
+			if ix.alias {
+				aliases[name] = map[string]interface{}{"aliases": map[string]interface{}{f.alias: map[string]interface{}{}}}
+			}
+		}
+		if len(aliases) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		json.NewEncoder(w).Encode(aliases)
+	case r.Method == http.MethodHead && len(parts) == 1:
+		if index == nil {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodGet && len(parts) == 2 && parts[1] == "_mapping":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			parts[0]: map[string]interface{}{"mappings": map[string]interface{}{"_meta": map[string]interface{}{mappingHashKey: index.hash}}},
+		})
+	case len(parts) == 2 && parts[1] == "_count":
+		json.NewEncoder(w).Encode(map[string]interface{}{"count": index.documents})
+	case r.Method == http.MethodPut && len(parts) == 1:
+		mappings, _ := body["mappings"].(map[string]interface{})
+		meta, _ := mappings["_meta"].(map[string]interface{})
+		hash, _ := meta[mappingHashKey].(string)
+		aliases, _ := body["aliases"].(map[string]interface{})
+		_, alias := aliases[f.alias]
+		f.indices[parts[0]] = &fakeIndex{hash: hash, alias: alias}
+		json.NewEncoder(w).Encode(map[string]interface{}{"acknowledged": true})
+	case r.Method == http.MethodPut && len(parts) == 2 && parts[1] == "_settings":
+		index.blocked, _ = body["index.blocks.write"].(bool)
+		json.NewEncoder(w).Encode(map[string]interface{}{"acknowledged": true})
+	case r.Method == http.MethodPost && parts[0] == "_reindex":
+		from := f.indices[body["source"].(map[string]interface{})["index"].(string)]
+		to := f.indices[body["dest"].(map[string]interface{})["index"].(string)]
+		to.documents = from.documents
+		f.copied = append(f.copied, from.blocked)
+		json.NewEncoder(w).Encode(map[string]interface{}{"total": from.documents, "created": from.documents})
+	case r.Method == http.MethodPost && parts[0] == "_aliases":
+		for _, action := range body["actions"].([]interface{}) {
+			for name, raw := range action.(map[string]interface{}) {
+				target := raw.(map[string]interface{})["index"].(string)
+				switch name {
+				case "add":
+					f.indices[target].alias = true
+				case "remove":
+					f.indices[target].alias = false
+				case "remove_index":
+					delete(f.indices, target)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"acknowledged": true})
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+var testMapping = map[string]interface{}{
+	"properties": map[string]interface{}{"objectId": map[string]interface{}{"type": "keyword"}},
+}
+
+func newTestManager(t *testing.T, indices map[string]*fakeIndex) (*IndexManager, *fakeCluster) {
+	t.Helper()
+	fake := &fakeCluster{alias: PlansAlias, indices: indices, fail: map[string]int{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIndexManager(es, PlansAlias, testMapping), fake
+}
+
+func currentHash(t *testing.T) string {
+	t.Helper()
+	hash, err := MappingHash(testMapping)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func TestCreateMakesTheFirstVersionedIndex(t *testing.T) {
+	manager, fake := newTestManager(t, map[string]*fakeIndex{})
+
+	index, err := manager.Create(context.Background())
+	if err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+	if index != "plans_v1" {
+		t.Errorf("Create() = %s, want plans_v1", index)
+	}
+	created := fake.indices["plans_v1"]
+	if created == nil || !created.alias || created.hash != currentHash(t) {
+		t.Errorf("plans_v1 = %+v, want it behind the alias with the current mapping hash", created)
+	}
+
+	if _, err := manager.Create(context.Background()); !errors.Is(err, ErrAliasExists) {
+		t.Errorf("second Create() error = %v, want ErrAliasExists", err)
+	}
+}
+
+func TestStatusComparesTheMappingHash(t *testing.T) {
+	manager, _ := newTestManager(t, map[string]*fakeIndex{
+		"plans_v3": {hash: "old", documents: 12, alias: true},
+	})
+
+	status, err := manager.Status(context.Background())
+	if err != nil {
+		t.Fatalf("Status() error = %v", err)
+	}
+	want := IndexStatus{Alias: PlansAlias, Index: "plans_v3", Version: 3, Documents: 12, MappingHash: "old", UpToDate: false}
+	if status != want {
+		t.Errorf("Status() = %+v, want %+v", status, want)
+	}
+
+	manager, _ = newTestManager(t, map[string]*fakeIndex{})
+	if _, err := manager.Status(context.Background()); !errors.Is(err, ErrNoIndex) {
+		t.Errorf("Status() without an index error = %v, want ErrNoIndex", err)
+	}
+}
+
+func TestMigrateCopiesWhileWritesAreBlocked(t *testing.T) {
+	manager, fake := newTestManager(t, map[string]*fakeIndex{
+		"plans_v1": {hash: "old", documents: 5, alias: true},
+	})
+
+	index, err := manager.Migrate(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if index != "plans_v2" {
+		t.Errorf("Migrate() = %s, want plans_v2", index)
+	}
+
+	calls := make([]string, 0)
+	for _, request := range fake.requests {
+		if strings.HasPrefix(request, "PUT") || strings.HasPrefix(request, "POST /_") {
+			calls = append(calls, request)
+		}
+	}
+	want := []string{
+		"PUT /plans_v2",
+		"PUT /plans_v1/_settings",
+		"POST /_reindex",
+		"POST /_aliases",
+		"PUT /plans_v1/_settings",
+	}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %v, want %v", calls, want)
+	}
+	// A single copy made while the old index was blocked, so a delete between
+	// the copy and the swap cannot be undone by a second copy
+	if !reflect.DeepEqual(fake.copied, []bool{true}) {
+		t.Errorf("copies made with write block = %v, want [true]", fake.copied)
+	}
+
+	old, next := fake.indices["plans_v1"], fake.indices["plans_v2"]
+	if old.alias || old.blocked {
+		t.Errorf("plans_v1 = %+v, want it off the alias and writable again", old)
+	}
+	if !next.alias || next.documents != 5 || next.hash != currentHash(t) {
+		t.Errorf("plans_v2 = %+v, want it behind the alias with the copied documents", next)
+	}
+
+	if _, err := manager.Migrate(context.Background(), false); !errors.Is(err, ErrUpToDate) {
+		t.Errorf("Migrate() of an up to date index error = %v, want ErrUpToDate", err)
+	}
+	if index, err := manager.Migrate(context.Background(), true); err != nil || index != "plans_v3" {
+		t.Errorf("forced Migrate() = %s, %v, want plans_v3", index, err)
+	}
+}
+
+func TestMigrateLiftsTheBlockWhenTheCopyFails(t *testing.T) {
+	manager, fake := newTestManager(t, map[string]*fakeIndex{
+		"plans_v1": {hash: "old", documents: 5, alias: true},
+	})
+	fake.fail["POST /_reindex"] = http.StatusInternalServerError
+
+	if _, err := manager.Migrate(context.Background(), false); err == nil {
+		t.Fatal("Migrate() error = nil, want the failed copy")
+	}
+	old := fake.indices["plans_v1"]
+	if !old.alias || old.blocked {
+		t.Errorf("plans_v1 = %+v, want it behind the alias and writable", old)
+	}
+}
+
+func TestMigrateReplacesAPlainIndex(t *testing.T) {
+	manager, fake := newTestManager(t, map[string]*fakeIndex{
+		PlansAlias: {documents: 2},
+	})
+
+	index, err := manager.Migrate(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if index != "plans_v1" {
+		t.Errorf("Migrate() = %s, want plans_v1", index)
+	}
+	if _, ok := fake.indices[PlansAlias]; ok {
+		t.Error("plain plans index still exists, want it removed by the swap")
+	}
+	if next := fake.indices["plans_v1"]; !next.alias || next.documents != 2 {
+		t.Errorf("plans_v1 = %+v, want it behind the alias with the copied documents", next)
+	}
+	if last := fake.requests[len(fake.requests)-1]; last != "POST /_aliases" {
+		t.Errorf("last request = %s, want the swap without lifting the block of the dropped index", last)
+	}
+}
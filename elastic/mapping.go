@@ -0,0 +1,154 @@
+package elastic
+
+import (
+	"fmt"
+	"github.com/girish332/bigdata/models"
+	"reflect"
+	"strings"
+)
+
+// JoinField is the join field relating the documents of a plan
+const JoinField = "plan_join"
+
+// Relation names of the plan_join field in the plans index
+const (
+	JoinPlan                  = "plan"
+	JoinPlanCostShares        = "planCostShares"
+	JoinLinkedPlanServices    = "linkedPlanServices"
+	JoinLinkedService         = "linkedService"
+	JoinPlanServiceCostShares = "planserviceCostShares"
+)
+
+// Mapping is the mapping of the plans index, applied to every versioned index
+// created behind the plans alias. The join documents of a plan are flat, so the
+// fields of the plan and all of its nested objects share one set of properties,
+// generated from the json and es struct tags of models.Plan.
+//
+// Fields default to keyword for strings, long for integers, double for floats
+// and boolean for bools. The es tag overrides that: `es:"text"` sets the type,
+// further comma separated key=value pairs are added to the field, for example
+// `es:"date,format=MM-dd-yyyy"`, fields.<name>=<type> adds a multi-field, for
+// example `es:"text,fields.keyword=keyword"`, and `es:"-"` leaves the field out.
+func Mapping() map[string]interface{} {
+	properties, err := Properties(reflect.TypeOf(models.Plan{}))
+	if err != nil {
+		panic(fmt.Sprintf("invalid plans mapping: %v", err))
+	}
+
+	properties[JoinField] = map[string]interface{}{
+		"type":                  "join",
+		"eager_global_ordinals": true,
+		"relations": map[string]interface{}{
+			JoinPlan:               []string{JoinPlanCostShares, JoinLinkedPlanServices},
+			JoinLinkedPlanServices: []string{JoinLinkedService, JoinPlanServiceCostShares},
+		},
+	}
+
+	return map[string]interface{}{
+		// Fields that are not part of the models are kept in _source but not indexed
+		"dynamic":    false,
+		"properties": properties,
+	}
+}
+
+// Properties generates the flat properties of a struct and every struct nested
+// in it, directly or through a slice. A field name used by several structs has
+// to map to the same definition everywhere.
+func Properties(t reflect.Type) (map[string]interface{}, error) {
+	properties := map[string]interface{}{}
+	err := addProperties(properties, t)
+	if err != nil {
+		return nil, err
+	}
+	return properties, nil
+}
+
+func addProperties(properties map[string]interface{}, t reflect.Type) error {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() || field.Tag.Get("es") == "-" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		// Nested objects are documents of their own, their fields live at the root
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Slice {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Struct {
+			err := addProperties(properties, fieldType)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		definition, err := fieldMapping(field.Tag.Get("es"), fieldType)
+		if err != nil {
+			return fmt.Errorf("field %s.%s: %w", t.Name(), field.Name, err)
+		}
+		if existing, ok := properties[name]; ok && !reflect.DeepEqual(existing, definition) {
+			return fmt.Errorf("field %s.%s: %s is mapped as %v elsewhere, not %v", t.Name(), field.Name, name, existing, definition)
+		}
+		properties[name] = definition
+	}
+	return nil
+}
+
+// fieldMapping builds the definition of one field from its es tag and Go type
+func fieldMapping(tag string, t reflect.Type) (map[string]interface{}, error) {
+	definition := map[string]interface{}{}
+	options := make([]string, 0)
+	if tag != "" {
+		options = strings.Split(tag, ",")
+		if !strings.Contains(options[0], "=") {
+			definition["type"] = options[0]
+			options = options[1:]
+		}
+	}
+
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid es tag option %q", option)
+		}
+		// fields.<name>=<type> adds a multi-field indexing the value a second way
+		if subfield, ok := strings.CutPrefix(key, "fields."); ok {
+			if subfield == "" || value == "" {
+				return nil, fmt.Errorf("invalid es tag option %q", option)
+			}
+			subfields, _ := definition["fields"].(map[string]interface{})
+			if subfields == nil {
+				subfields = map[string]interface{}{}
+				definition["fields"] = subfields
+			}
+			subfields[subfield] = map[string]interface{}{"type": value}
+			continue
+		}
+		definition[key] = value
+	}
+
+	if _, ok := definition["type"]; !ok {
+		switch t.Kind() {
+		case reflect.String:
+			definition["type"] = "keyword"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			definition["type"] = "long"
+		case reflect.Float32, reflect.Float64:
+			definition["type"] = "double"
+		case reflect.Bool:
+			definition["type"] = "boolean"
+		default:
+			return nil, fmt.Errorf("no default type for %s, set one with an es tag", t)
+		}
+	}
+	return definition, nil
+}
@@ -0,0 +1,74 @@
+package elastic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMappingIsFlat(t *testing.T) {
+	properties := Mapping()["properties"].(map[string]interface{})
+
+	want := map[string]map[string]interface{}{
+		"objectId":     {"type": "keyword"},
+		"objectType":   {"type": "keyword"},
+		"_org":         {"type": "keyword"},
+		"planType":     {"type": "keyword"},
+		"creationDate": {"type": "date", "format": "MM-dd-yyyy"},
+		"copay":        {"type": "long"},
+		"deductible":   {"type": "long"},
+		"name": {"type": "text", "fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword"},
+			"suggest": map[string]interface{}{"type": "search_as_you_type"},
+		}},
+	}
+	for name, definition := range want {
+		if got := properties[name]; !reflect.DeepEqual(got, definition) {
+			t.Errorf("%s is mapped as %v, want %v", name, got, definition)
+		}
+	}
+
+	// Nested objects are separate join documents, not object properties
+	for _, nested := range []string{"planCostShares", "linkedPlanServices", "linkedService", "planserviceCostShares"} {
+		if _, ok := properties[nested]; ok {
+			t.Errorf("%s should not be a property of the flat documents", nested)
+		}
+	}
+
+	join, ok := properties[JoinField].(map[string]interface{})
+	if !ok || join["type"] != "join" {
+		t.Fatalf("%s is mapped as %v, want a join field", JoinField, properties[JoinField])
+	}
+}
+
+func TestPropertiesOverridesAndConflicts(t *testing.T) {
+	type child struct {
+		Amount  float64 `json:"amount"`
+		Ignored string  `json:"ignored" es:"-"`
+		Score   int     `json:"score" es:"integer,coerce=false"`
+	}
+	type parent struct {
+		Children []child `json:"children"`
+		Active   bool    `json:"active"`
+	}
+
+	properties, err := Properties(reflect.TypeOf(parent{}))
+	if err != nil {
+		t.Fatalf("Properties() error = %v", err)
+	}
+	want := map[string]interface{}{
+		"amount": map[string]interface{}{"type": "double"},
+		"score":  map[string]interface{}{"type": "integer", "coerce": "false"},
+		"active": map[string]interface{}{"type": "boolean"},
+	}
+	if !reflect.DeepEqual(properties, want) {
+		t.Errorf("Properties() = %v, want %v", properties, want)
+	}
+
+	type conflicting struct {
+		Child  child  `json:"child"`
+		Amount string `json:"amount"`
+	}
+	if _, err := Properties(reflect.TypeOf(conflicting{})); err == nil {
+		t.Error("Properties() accepted a field mapped with two different types")
+	}
+}
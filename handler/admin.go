@@ -0,0 +1,96 @@
+package handler
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/service"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+type AdminHandler struct {
+	reindex     *service.ReindexService
+	consistency *service.ConsistencyService
+}
+
+func NewAdminHandler(reindexService *service.ReindexService, consistencyService *service.ConsistencyService) *AdminHandler {
+	return &AdminHandler{
+		reindex:     reindexService,
+		consistency: consistencyService,
+	}
+}
+
+// StartReindex starts a full reindex from Redis in the background. The batch and
+// rate query parameters tune it, and resume=true continues an unfinished one.
+func (ah *AdminHandler) StartReindex(c *gin.Context) {
+	var opts service.ReindexOptions
+	var err error
+	if batch := c.Query("batch"); batch != "" {
+		opts.BatchSize, err = strconv.ParseInt(batch, 10, 64)
+		if err != nil || opts.BatchSize < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "batch must be a positive integer"})
+			return
+		}
+	}
+	if rate := c.Query("rate"); rate != "" {
+		opts.Rate, err = strconv.Atoi(rate)
+		if err != nil || opts.Rate < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "rate must be a non negative integer"})
+			return
+		}
+	}
+	opts.Resume = c.Query("resume") == "true"
+
+	state, err := ah.reindex.Start(c, opts)
+	if err != nil {
+		if errors.Is(err, service.ErrReindexRunning) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Failed to start the reindex with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, state)
+}
+
+// GetReindex reports the progress of the last reindex
+func (ah *AdminHandler) GetReindex(c *gin.Context) {
+	state, err := ah.reindex.State(c)
+	if err != nil {
+		log.Printf("Failed to read the reindex state with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if state == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no reindex has run yet"})
+		return
+	}
+
+	c.JSON(http.StatusOK, state)
+}
+
+// CheckConsistency compares the plans in Redis with the search index and reports
+// the drift without changing anything
+func (ah *AdminHandler) CheckConsistency(c *gin.Context) {
+	ah.checkConsistency(c, false)
+}
+
+// RepairConsistency compares the plans in Redis with the search index and repairs
+// the drift it finds
+func (ah *AdminHandler) RepairConsistency(c *gin.Context) {
+	ah.checkConsistency(c, true)
+}
+
+func (ah *AdminHandler) checkConsistency(c *gin.Context, repair bool) {
+	report, err := ah.consistency.Check(c, repair)
+	if err != nil {
+		log.Printf("Failed to check consistency with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
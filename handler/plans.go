@@ -1,23 +1,26 @@
 package handler
 
 import (
-	"bytes"
-	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
-	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/girish332/bigdata/elastic"
 	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/patch"
 	"github.com/girish332/bigdata/service"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+const (
+	defaultPageLimit = 20
+	maxPageLimit     = 100
+)
+
 type Handler interface {
 	CreatePlan(c *gin.Context)
 	GetPlan(c *gin.Context)
@@ -25,27 +28,21 @@ type Handler interface {
 	DeletePlan(c *gin.Context)
 	PatchPlan(c *gin.Context)
 	UpdatePlan(c *gin.Context)
-	SearchPlans(c *gin.Context)
 }
 
 type PlansHandler struct {
-	service   *service.PlansService
-	esFactory *elastic.Factory
+	service *service.PlansService
 }
 
-func NewPlansHandler(planService *service.PlansService, esFactory *elastic.Factory) *PlansHandler {
+func NewPlansHandler(planService *service.PlansService) *PlansHandler {
 	return &PlansHandler{
-		service:   planService,
-		esFactory: esFactory,
+		service: planService,
 	}
 }
 
 func (ph *PlansHandler) CreatePlan(c *gin.Context) {
 	var planRequest models.Plan
-	err := c.ShouldBindBodyWith(&planRequest, binding.JSON)
-	if err != nil {
-		log.Printf("Bad Request with error : %v", err.Error())
-		c.AbortWithStatus(http.StatusBadRequest)
+	if !ph.bindPlan(c, &planRequest) {
 		return
 	}
 
@@ -58,6 +55,14 @@ func (ph *PlansHandler) CreatePlan(c *gin.Context) {
 
 	err = ph.service.CreatePlan(c, planRequest)
 	if err != nil {
+		if errors.Is(err, service.ErrPlanExists) || errors.Is(err, service.ErrConflict) {
+			c.AbortWithStatus(http.StatusConflict)
+			return
+		}
+		if errors.Is(err, service.ErrObjectIdInUse) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
 		log.Printf("Failed to create plan with error : %v", err.Error())
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -80,13 +85,18 @@ func (ph *PlansHandler) GetPlan(c *gin.Context) {
 
 	plan, err := ph.service.GetAnyObject(c, objectId)
 	if err != nil {
+		if errors.Is(err, service.ErrPlanNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
 		log.Printf("Failed to fetch plan with err : %v", err.Error())
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
 	currentEtag := generateETag(plan)
-	if clientEtag == currentEtag {
+	c.Header("ETag", currentEtag)
+	if clientEtag != "" && etagMatches(clientEtag, currentEtag) {
 		c.Status(http.StatusNotModified)
 		return
 	}
@@ -102,14 +112,17 @@ func (ph *PlansHandler) DeletePlan(c *gin.Context) {
 		return
 	}
 
-	err := ph.service.DeletePlan(c, objectId)
+	err := ph.service.DeletePlan(c, objectId, ifMatch(c))
 	if err != nil {
-		if err.Error() == "key not found" {
+		if errors.Is(err, service.ErrPlanNotFound) {
 			c.AbortWithStatus(http.StatusNotFound)
 			return
 		}
+		if abortOnPrecondition(c, err) {
+			return
+		}
 		log.Printf("Failed to delete plan with err : %v", err.Error())
-		c.AbortWithStatus(http.StatusNotFound)
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
@@ -119,8 +132,22 @@ func (ph *PlansHandler) DeletePlan(c *gin.Context) {
 }
 
 func (ph *PlansHandler) GetAllPlans(c *gin.Context) {
-	plans, err := ph.service.GetAllPlans(c)
+	limit := int64(defaultPageLimit)
+	if rawLimit := c.Query("limit"); rawLimit != "" {
+		parsed, err := strconv.ParseInt(rawLimit, 10, 64)
+		if err != nil || parsed < 1 || parsed > maxPageLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(maxPageLimit)})
+			return
+		}
+		limit = parsed
+	}
+
+	plans, err := ph.service.GetAllPlans(c, c.Query("cursor"), limit)
 	if err != nil {
+		if errors.Is(err, service.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		log.Printf("Failed to fetch all plans with err : %v", err.Error())
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
@@ -137,39 +164,56 @@ func (ph *PlansHandler) PatchPlan(c *gin.Context) {
 		return
 	}
 
-	clientEtag := strings.TrimSpace(c.GetHeader("If-None-Match"))
-	if clientEtag == "" {
-		c.AbortWithStatus(http.StatusPreconditionFailed)
-		return
-	}
-
-	var planRequest models.Plan
-	err := c.ShouldBindBodyWith(&planRequest, binding.JSON)
-	if err != nil {
-		log.Printf("Bad Request with error : %v", err.Error())
-		c.AbortWithStatus(http.StatusBadRequest)
-		return
-	}
-
-	existingPlan, err := ph.service.GetPlan(c, objectId)
-	if err != nil || existingPlan.ObjectId == "" {
-		c.AbortWithStatus(http.StatusNotFound)
-		return
+	var planPatch patch.Patch
+	switch c.ContentType() {
+	case patch.MergePatchContentType:
+		body, err := c.GetRawData()
+		if err != nil || !json.Valid(body) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "request body is not a valid merge patch document"})
+			return
+		}
+		planPatch = patch.MergePatch(body)
+	case patch.JSONPatchContentType:
+		body, err := c.GetRawData()
+		if err != nil {
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		jsonPatch, err := patch.DecodeJSONPatch(body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		planPatch = jsonPatch
+	default:
+		var planRequest models.Plan
+		err := c.ShouldBindBodyWith(&planRequest, binding.JSON)
+		if err != nil {
+			log.Printf("Bad Request with error : %v", err.Error())
+			c.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		planPatch = service.LinkedPlanServicesPatch(planRequest)
 	}
 
-	err = ph.service.PatchPlan(c, objectId, planRequest)
+	patchedPlan, err := ph.service.PatchPlan(c, objectId, planPatch, ifMatch(c))
 	if err != nil {
+		if errors.Is(err, service.ErrPlanNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if abortOnPatchError(c, err) || abortOnSchemaError(c, err) {
+			return
+		}
+		if abortOnPrecondition(c, err) {
+			return
+		}
 		log.Printf("Failed to update plan with error : %v", err.Error())
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	currentEtag := generateETag(planRequest)
-	if clientEtag == currentEtag {
-		c.Status(http.StatusNotModified)
-		return
-	}
-
+	c.Header("ETag", generateETag(patchedPlan))
 	c.JSON(http.StatusOK, gin.H{"message": "Plan updated successfully"})
 	return
 }
@@ -184,107 +228,162 @@ func generateETag(plan interface{}) string {
 	h.Write(dataBytes)
 	sha1Hash := hex.EncodeToString(h.Sum(nil))
 
-	return sha1Hash
+	// An entity tag is a quoted string (RFC 7232)
+	return `"` + sha1Hash + `"`
 }
 
-func (ph *PlansHandler) UpdatePlan(c *gin.Context) {
-	var planRequest models.Plan
-	err := c.ShouldBindBodyWith(&planRequest, binding.JSON)
+// bindPlan validates the request body against the registered schemas and binds it
+// into plan. It writes the error response itself and reports whether it succeeded.
+func (ph *PlansHandler) bindPlan(c *gin.Context, plan *models.Plan) bool {
+	body, err := c.GetRawData()
 	if err != nil {
-		log.Printf("Bad Request with error : %v", err.Error())
 		c.AbortWithStatus(http.StatusBadRequest)
-		return
+		return false
 	}
 
-	existingPlan, err := ph.service.GetPlan(c, planRequest.ObjectId)
-	if err != nil || existingPlan.ObjectId == "" {
-		// If the plan does not exist, create a new one
-		err = ph.service.CreatePlan(c, planRequest)
-		if err != nil {
-			log.Printf("Failed to create plan with error : %v", err.Error())
+	err = ph.service.ValidateDocument(c, body)
+	if err != nil {
+		if !abortOnSchemaError(c, err) {
+			log.Printf("Failed to validate plan with error : %v", err.Error())
 			c.AbortWithStatus(http.StatusInternalServerError)
-			return
 		}
-		c.JSON(http.StatusCreated, gin.H{"message": "Plan created successfully"})
-		return
+		return false
 	}
 
-	// If the ETag of the existing plan and the request are the same, return a 304 status
-	requestETag := generateETag(planRequest)
-	existingETag := generateETag(existingPlan)
-	if requestETag == existingETag {
-		c.Status(http.StatusNotModified)
-		return
-	}
-
-	err = ph.service.UpdatePlan(c, planRequest.ObjectId, planRequest)
+	err = binding.JSON.BindBody(body, plan)
 	if err != nil {
-		log.Printf("Failed to update plan with error : %v", err.Error())
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		log.Printf("Bad Request with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusBadRequest)
+		return false
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Plan updated successfully"})
-	return
+	return true
 }
 
-func (h *PlansHandler) SearchPlans(c *gin.Context) {
-	var req models.SearchRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
+// abortOnPatchError maps the errors of applying a patch to their status codes and
+// reports whether the request was aborted. A malformed patch is a bad request, a
+// failed test a conflict with the stored plan, and a patch that cannot be applied
+// to the plan or leaves it invalid is unprocessable.
+func abortOnPatchError(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, patch.ErrInvalidPatch):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, patch.ErrTestFailed):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case errors.Is(err, patch.ErrInvalidPath), errors.Is(err, service.ErrInvalidPlan), errors.Is(err, service.ErrObjectIdChanged):
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	default:
+		return false
 	}
+	return true
+}
 
-	// Create a match query
-	matchQuery := map[string]interface{}{
-		"query": map[string]interface{}{
-			"match": map[string]interface{}{
-				req.Key: req.Value,
-			},
-		},
-	}
-	queryBytes, err := json.Marshal(matchQuery)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+// abortOnSchemaError answers with the list of schema violations and reports
+// whether err was a schema error
+func abortOnSchemaError(c *gin.Context, err error) bool {
+	var schemaErr *service.SchemaError
+	if !errors.As(err, &schemaErr) {
+		return false
 	}
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": schemaErr.Error(), "errors": schemaErr.Errors})
+	return true
+}
 
-	// Create a new search request
-	searchReq := esapi.SearchRequest{
-		Index: []string{"plans"},
-		Body:  bytes.NewReader(queryBytes),
+// ifMatch builds the precondition for the If-Match header of the request. The
+// check runs against the stored plan inside the write transaction, so a plan that
+// changes between the check and the write makes the write fail instead.
+func ifMatch(c *gin.Context) service.Precondition {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	return func(existing *models.Plan) error {
+		if header == "" {
+			return service.ErrPreconditionRequired
+		}
+		if existing == nil || !etagMatches(header, generateETag(*existing)) {
+			return service.ErrPreconditionFailed
+		}
+		return nil
 	}
+}
 
-	// Create a new Elasticsearch client
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200", // replace with your Elasticsearch address
-		},
+// etagMatches reports whether an If-Match or If-None-Match header value matches the
+// current ETag. The header may be a comma separated list of quoted or weak tags, or *.
+// Unquoted tags, as sent to clients before the ETag was quoted, match too.
+func etagMatches(header, etag string) bool {
+	etag = strings.Trim(etag, `"`)
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		candidate = strings.Trim(strings.TrimPrefix(candidate, "W/"), `"`)
+		if candidate == etag {
+			return true
+		}
 	}
-	client, err := h.esFactory.NewClient(cfg)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+	return false
+}
+
+// abortOnPrecondition maps the precondition and write conflict errors of the service
+// to their status codes and reports whether the request was aborted.
+func abortOnPrecondition(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, service.ErrPreconditionRequired):
+		c.AbortWithStatusJSON(http.StatusPreconditionRequired, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrPreconditionFailed):
+		c.AbortWithStatusJSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	case errors.Is(err, service.ErrConflict):
+		c.AbortWithStatus(http.StatusConflict)
+	case errors.Is(err, service.ErrObjectIdInUse):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		return false
 	}
+	return true
+}
 
-	// Perform the search request.
-	res, err := searchReq.Do(context.Background(), client.ES)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+func (ph *PlansHandler) UpdatePlan(c *gin.Context) {
+	var planRequest models.Plan
+	if !ph.bindPlan(c, &planRequest) {
 		return
 	}
-	defer res.Body.Close()
 
-	if res.IsError() {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": res.String()})
+	existingPlan, err := ph.service.GetPlan(c, planRequest.ObjectId)
+	if err != nil || existingPlan.ObjectId == "" {
+		// If the plan does not exist, create a new one
+		if c.GetHeader("If-Match") != "" {
+			// A precondition on a plan that does not exist can never hold
+			c.AbortWithStatus(http.StatusPreconditionFailed)
+			return
+		}
+		err = ph.service.CreatePlan(c, planRequest)
+		if err != nil {
+			if errors.Is(err, service.ErrPlanExists) || errors.Is(err, service.ErrConflict) {
+				c.AbortWithStatus(http.StatusConflict)
+				return
+			}
+			if errors.Is(err, service.ErrObjectIdInUse) {
+				c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+				return
+			}
+			log.Printf("Failed to create plan with error : %v", err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.Header("ETag", generateETag(planRequest))
+		c.JSON(http.StatusCreated, gin.H{"message": "Plan created successfully"})
 		return
 	}
 
-	var result map[string]interface{}
-	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	err = ph.service.UpdatePlan(c, planRequest.ObjectId, planRequest, ifMatch(c))
+	if err != nil {
+		if abortOnPrecondition(c, err) {
+			return
+		}
+		log.Printf("Failed to update plan with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.Header("ETag", generateETag(planRequest))
+	c.JSON(http.StatusOK, gin.H{"message": "Plan updated successfully"})
+	return
 }
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/outbox"
+	"github.com/girish332/bigdata/patch"
+	"github.com/girish332/bigdata/repository"
+	"github.com/girish332/bigdata/service"
+)
+
+// memRepo is an in memory keyspace serving the reads and transactions of the plans service
+type memRepo struct {
+	repository.RedisRepo
+	values map[string]string
+}
+
+func (r *memRepo) Get(_ context.Context, key string) (string, error) {
+	value, ok := r.values[key]
+	if !ok {
+		return "", repository.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (r *memRepo) Tx(_ context.Context, _ []string, fn func(tx repository.RedisTx) error) error {
+	tx := &memTx{repo: r}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for _, op := range tx.queued {
+		op()
+	}
+	return nil
+}
+
+type memTx struct {
+	repo   *memRepo
+	queued []func()
+}
+
+func (t *memTx) Watch(...string) error { return nil }
+
+func (t *memTx) Get(key string) (string, error) {
+	return t.repo.Get(context.Background(), key)
+}
+
+func (t *memTx) Set(key, value string) {
+	t.queued = append(t.queued, func() { t.repo.values[key] = value })
+}
+
+func (t *memTx) SetPersistent(key, value string) { t.Set(key, value) }
+
+func (t *memTx) Delete(key string) {
+	t.queued = append(t.queued, func() { delete(t.repo.values, key) })
+}
+
+func (t *memTx) ZAdd(string, string)  {}
+func (t *memTx) ZRem(string, string)  {}
+func (t *memTx) RPush(string, string) {}
+
+func planBody(objectId string) string {
+	return `{
+		"planCostShares": {"deductible": 2000, "_org": "example.com", "copay": 23, "objectId": "` + objectId + `-pcs", "objectType": "membercostshare"},
+		"linkedPlanServices": [{
+			"linkedService": {"_org": "example.com", "objectId": "` + objectId + `-ls", "objectType": "service", "name": "Yearly physical"},
+			"planserviceCostShares": {"deductible": 10, "_org": "example.com", "copay": 0, "objectId": "` + objectId + `-pscs", "objectType": "membercostshare"},
+			"_org": "example.com", "objectId": "` + objectId + `-lps", "objectType": "planservice"
+		}],
+		"_org": "example.com", "objectId": "` + objectId + `", "objectType": "plan", "planType": "inNetwork", "creationDate": "12-12-2017"
+	}`
+}
+
+func newTestRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	repo := &memRepo{values: map[string]string{}}
+	ph := NewPlansHandler(service.NewPlansService(repo, service.NewSchemaService(repo), outbox.NewRelay(repo, nil)))
+
+	router := gin.New()
+	router.POST("/plan", ph.CreatePlan)
+	router.PUT("/plan", ph.UpdatePlan)
+	router.GET("/plan/:objectId", ph.GetPlan)
+	router.DELETE("/plan/:objectId", ph.DeletePlan)
+	return router
+}
+
+var quotedETag = regexp.MustCompile(`^"[0-9a-f]{40}"$`)
+
+func TestPreconditions(t *testing.T) {
+	router := newTestRouter()
+	etag := ""
+
+	steps := []struct {
+		name, method, path, body string
+		// ifMatch is sent as If-Match with {etag} replaced by the current ETag, or
+		// as If-None-Match for GET
+		ifMatch string
+		want    int
+	}{
+		{name: "create", method: http.MethodPost, path: "/plan", body: planBody("plan-1"), want: http.StatusCreated},
+		{name: "get", method: http.MethodGet, path: "/plan/plan-1", want: http.StatusOK},
+		{name: "get unchanged", method: http.MethodGet, path: "/plan/plan-1", ifMatch: "{etag}", want: http.StatusNotModified},
+		{name: "update without If-Match", method: http.MethodPut, path: "/plan", body: planBody("plan-1"), want: http.StatusPreconditionRequired},
+		{name: "update with another ETag", method: http.MethodPut, path: "/plan", body: planBody("plan-1"), ifMatch: `"0000"`, want: http.StatusPreconditionFailed},
+		{name: "update with the ETag in a list", method: http.MethodPut, path: "/plan", body: planBody("plan-1"), ifMatch: `"0000", {etag}`, want: http.StatusOK},
+		{name: "update with a weak ETag", method: http.MethodPut, path: "/plan", body: planBody("plan-1"), ifMatch: "W/{etag}", want: http.StatusOK},
+		{name: "update with an unquoted ETag", method: http.MethodPut, path: "/plan", body: planBody("plan-1"), ifMatch: "{unquoted}", want: http.StatusOK},
+		{name: "update with *", method: http.MethodPut, path: "/plan", body: planBody("plan-1"), ifMatch: "*", want: http.StatusOK},
+		{name: "create through PUT with If-Match", method: http.MethodPut, path: "/plan", body: planBody("plan-2"), ifMatch: "*", want: http.StatusPreconditionFailed},
+		{name: "create through PUT", method: http.MethodPut, path: "/plan", body: planBody("plan-2"), want: http.StatusCreated},
+		{name: "delete without If-Match", method: http.MethodDelete, path: "/plan/plan-1", want: http.StatusPreconditionRequired},
+		{name: "delete with another ETag", method: http.MethodDelete, path: "/plan/plan-1", ifMatch: `"0000"`, want: http.StatusPreconditionFailed},
+		{name: "delete", method: http.MethodDelete, path: "/plan/plan-1", ifMatch: "{etag}", want: http.StatusNoContent},
+		{name: "delete a deleted plan", method: http.MethodDelete, path: "/plan/plan-1", ifMatch: "*", want: http.StatusNotFound},
+	}
+	for _, step := range steps {
+		req := httptest.NewRequest(step.method, step.path, strings.NewReader(step.body))
+		req.Header.Set("Content-Type", "application/json")
+		if step.ifMatch != "" {
+			value := strings.NewReplacer("{etag}", etag, "{unquoted}", strings.Trim(etag, `"`)).Replace(step.ifMatch)
+			header := "If-Match"
+			if step.method == http.MethodGet {
+				header = "If-None-Match"
+			}
+			req.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != step.want {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.want, w.Body.String())
+		}
+		if got := w.Header().Get("ETag"); w.Code < http.StatusMultipleChoices && step.method != http.MethodDelete {
+			if !quotedETag.MatchString(got) {
+				t.Errorf("%s: ETag = %s, want a quoted SHA-1", step.name, got)
+			}
+			if strings.Contains(step.path, "plan-1") || strings.Contains(step.body, `"objectId": "plan-1"`) {
+				etag = got
+			}
+		}
+	}
+}
+
+func TestAbortOnPatchError(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := map[string]struct {
+		err  error
+		want int
+	}{
+		"invalid patch":     {fmt.Errorf("%w: operation 0: unknown op", patch.ErrInvalidPatch), http.StatusBadRequest},
+		"failed test":       {fmt.Errorf("operation 1 (test /planType): %w", patch.ErrTestFailed), http.StatusConflict},
+		"invalid path":      {fmt.Errorf("operation 0 (remove /missing): %w", patch.ErrInvalidPath), http.StatusUnprocessableEntity},
+		"invalid plan":      {fmt.Errorf("%w: missing planType", service.ErrInvalidPlan), http.StatusUnprocessableEntity},
+		"objectId changed":  {service.ErrObjectIdChanged, http.StatusUnprocessableEntity},
+		"other error":       {errors.New("redis is down"), 0},
+		"precondition":      {service.ErrPreconditionFailed, 0},
+		"plan is not found": {service.ErrPlanNotFound, 0},
+	}
+	for name, tt := range tests {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+
+		aborted := abortOnPatchError(c, tt.err)
+		if aborted != (tt.want != 0) {
+			t.Errorf("%s: abortOnPatchError() = %t, want %t", name, aborted, tt.want != 0)
+			continue
+		}
+		if aborted && w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/schema"
+	"github.com/girish332/bigdata/service"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+)
+
+type SchemaHandler struct {
+	service *service.SchemaService
+}
+
+func NewSchemaHandler(schemaService *service.SchemaService) *SchemaHandler {
+	return &SchemaHandler{
+		service: schemaService,
+	}
+}
+
+func (sh *SchemaHandler) CreateSchema(c *gin.Context) {
+	objectType, ok := c.Params.Get("objectType")
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	body, err := c.GetRawData()
+	if err != nil || !json.Valid(body) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "request body is not valid JSON"})
+		return
+	}
+
+	err = sh.service.SaveSchema(c, objectType, body)
+	if err != nil {
+		if errors.Is(err, schema.ErrInvalidSchema) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Failed to save schema with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"message": "Schema saved successfully"})
+}
+
+func (sh *SchemaHandler) GetSchema(c *gin.Context) {
+	objectType, ok := c.Params.Get("objectType")
+	if !ok {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	raw, err := sh.service.GetSchema(c, objectType)
+	if err != nil {
+		if errors.Is(err, service.ErrSchemaNotFound) {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		log.Printf("Failed to fetch schema with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusOK, "application/schema+json", raw)
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/search"
+	"github.com/girish332/bigdata/service"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+)
+
+type SearchHandler struct {
+	service *service.SearchService
+}
+
+func NewSearchHandler(searchService *service.SearchService) *SearchHandler {
+	return &SearchHandler{
+		service: searchService,
+	}
+}
+
+// Search runs a structured search over the plan documents. With resolve=plans
+// the hits are replaced by the plans they belong to. The cursor query parameter
+// reads the next page of a paginate=cursor search, without a request body.
+func (sh *SearchHandler) Search(c *gin.Context) {
+	resolve, ok := resolvePlans(c)
+	if !ok {
+		return
+	}
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		body, err := c.GetRawData()
+		if err != nil || len(bytes.TrimSpace(body)) > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "the next page of a cursor takes no request body"})
+			return
+		}
+		result, err := sh.service.Next(c, cursor)
+		sh.respond(c, resolve, result, err)
+		return
+	}
+
+	var req search.Request
+	err := search.Decode(c.Request.Body, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := sh.service.Search(c, req)
+	sh.respond(c, resolve, result, err)
+}
+
+// HasChild searches documents by their children, returning the matched children
+// of every hit when innerHits is set
+func (sh *SearchHandler) HasChild(c *gin.Context) {
+	sh.relationSearch(c, sh.service.HasChild)
+}
+
+// HasParent searches documents by their parents, returning the matched parents
+// of every hit when innerHits is set
+func (sh *SearchHandler) HasParent(c *gin.Context) {
+	sh.relationSearch(c, sh.service.HasParent)
+}
+
+func (sh *SearchHandler) relationSearch(c *gin.Context, run func(context.Context, search.RelationRequest) (service.SearchResult, error)) {
+	resolve, ok := resolvePlans(c)
+	if !ok {
+		return
+	}
+
+	var req search.RelationRequest
+	err := search.Decode(c.Request.Body, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := run(c, req)
+	sh.respond(c, resolve, result, err)
+}
+
+// resolvePlans reads the resolve query parameter, answering 400 to anything
+// other than plans
+func resolvePlans(c *gin.Context) (bool, bool) {
+	switch c.Query("resolve") {
+	case "":
+		return false, true
+	case "plans":
+		return true, true
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "resolve must be plans"})
+	return false, false
+}
+
+// respond writes the result of a search, resolved to plans if asked for
+func (sh *SearchHandler) respond(c *gin.Context, resolve bool, result service.SearchResult, err error) {
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Failed to search plans with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !resolve {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+	plans, err := sh.service.Resolve(c, result)
+	if err != nil {
+		log.Printf("Failed to resolve the plans of a search with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	c.JSON(http.StatusOK, plans)
+}
+
+// Analytics aggregates the numeric fields of the plan documents. The table is
+// returned as JSON, or as CSV with format=csv.
+func (sh *SearchHandler) Analytics(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	var req search.AnalyticsRequest
+	err := search.Decode(c.Request.Body, &req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	table, err := sh.service.Analytics(c, req)
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Failed to run analytics with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		err = table.WriteCSV(c.Writer)
+		if err != nil {
+			log.Printf("Failed to write the analytics CSV with error : %v", err.Error())
+		}
+		return
+	}
+	c.JSON(http.StatusOK, table)
+}
+
+// SuggestServices completes linked service names for type-ahead, from the q
+// query parameter. size limits the number of names returned.
+func (sh *SearchHandler) SuggestServices(c *gin.Context) {
+	size := 0
+	if rawSize := c.Query("size"); rawSize != "" {
+		parsed, err := strconv.Atoi(rawSize)
+		if err != nil || parsed < 1 || parsed > search.MaxSuggestions {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "size must be between 1 and " + strconv.Itoa(search.MaxSuggestions)})
+			return
+		}
+		size = parsed
+	}
+
+	suggestions, err := sh.service.SuggestServices(c, c.Query("q"), size)
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidQuery) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		log.Printf("Failed to suggest services with error : %v", err.Error())
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"suggestions": suggestions})
+}
@@ -0,0 +1,100 @@
+package indexer
+
+import (
+	"github.com/girish332/bigdata/elastic"
+	"github.com/girish332/bigdata/models"
+)
+
+// Document is one parent or child document of a plan in the join index
+type Document struct {
+	ID string
+	// Routing is the objectId of the root plan for every document, since all
+	// documents of a join hierarchy have to live on the shard of their root
+	Routing string
+	Body    map[string]interface{}
+}
+
+// Documents turns a plan into its join documents, the plan first and every
+// parent before its children. Nested objects are indexed as their own documents
+// and left out of the body of their parent.
+func Documents(plan models.Plan) []Document {
+	root := plan.ObjectId
+	documents := []Document{
+		{
+			ID:      plan.ObjectId,
+			Routing: root,
+			Body: map[string]interface{}{
+				"plan_join":    join(elastic.JoinPlan, ""),
+				"objectId":     plan.ObjectId,
+				"objectType":   plan.ObjectType,
+				"planType":     plan.PlanType,
+				"creationDate": plan.CreationDate,
+				"_org":         plan.Org,
+			},
+		},
+		{
+			ID:      plan.PlanCostShares.ObjectId,
+			Routing: root,
+			Body:    costShares(plan.PlanCostShares.Deductible, plan.PlanCostShares.Copay, plan.PlanCostShares.ObjectId, plan.PlanCostShares.ObjectType, plan.PlanCostShares.Org, join(elastic.JoinPlanCostShares, root)),
+		},
+	}
+
+	for _, linkedPlanService := range plan.LinkedPlanServices {
+		parent := linkedPlanService.ObjectId
+		linkedService := linkedPlanService.LinkedService
+		planServiceCostShares := linkedPlanService.PlanServiceCostShares
+
+		documents = append(documents,
+			Document{
+				ID:      linkedPlanService.ObjectId,
+				Routing: root,
+				Body: map[string]interface{}{
+					"plan_join":  join(elastic.JoinLinkedPlanServices, root),
+					"objectId":   linkedPlanService.ObjectId,
+					"objectType": linkedPlanService.ObjectType,
+					"_org":       linkedPlanService.Org,
+				},
+			},
+			Document{
+				ID:      linkedService.ObjectId,
+				Routing: root,
+				Body: map[string]interface{}{
+					"plan_join":  join(elastic.JoinLinkedService, parent),
+					"objectId":   linkedService.ObjectId,
+					"objectType": linkedService.ObjectType,
+					"name":       linkedService.Name,
+					"_org":       linkedService.Org,
+				},
+			},
+			Document{
+				ID:      planServiceCostShares.ObjectId,
+				Routing: root,
+				Body:    costShares(planServiceCostShares.Deductible, planServiceCostShares.Copay, planServiceCostShares.ObjectId, planServiceCostShares.ObjectType, planServiceCostShares.Org, join(elastic.JoinPlanServiceCostShares, parent)),
+			},
+		)
+	}
+
+	return documents
+}
+
+func costShares(deductible, copay int, objectId, objectType, org string, planJoin map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"plan_join":  planJoin,
+		"deductible": deductible,
+		"copay":      copay,
+		"objectId":   objectId,
+		"objectType": objectType,
+		"_org":       org,
+	}
+}
+
+// join builds the plan_join value of a document, parent is empty for the root plan
+func join(name, parent string) map[string]interface{} {
+	planJoin := map[string]interface{}{
+		"name": name,
+	}
+	if parent != "" {
+		planJoin["parent"] = parent
+	}
+	return planJoin
+}
@@ -0,0 +1,133 @@
+package indexer
+
+import (
+	"testing"
+
+	"github.com/girish332/bigdata/elastic"
+	"github.com/girish332/bigdata/models"
+)
+
+func testPlan() models.Plan {
+	return models.Plan{
+		PlanCostShares: models.PlanCostShares{
+			Deductible: 2000,
+			Copay:      23,
+			ObjectId:   "1234vxc2324sdf-501",
+			ObjectType: "membercostshare",
+			Org:        "example.com",
+		},
+		LinkedPlanServices: []models.LinkedPlanService{
+			{
+				LinkedService: models.LinkedService{
+					ObjectId:   "1234520xvc30asdf-502",
+					ObjectType: "service",
+					Name:       "Yearly physical",
+					Org:        "example.com",
+				},
+				PlanServiceCostShares: models.PlanServiceCostShares{
+					Deductible: 10,
+					Copay:      0,
+					ObjectId:   "1234512xvc1314asdfs-503",
+					ObjectType: "membercostshare",
+					Org:        "example.com",
+				},
+				ObjectId:   "27283xvx9asdff-504",
+				ObjectType: "planservice",
+				Org:        "example.com",
+			},
+		},
+		ObjectId:     "12xvxc345ssdsds-508",
+		ObjectType:   "plan",
+		PlanType:     "inNetwork",
+		CreationDate: "12-12-2017",
+		Org:          "example.com",
+	}
+}
+
+func TestDocumentsJoinHierarchy(t *testing.T) {
+	documents := Documents(testPlan())
+
+	expected := []struct {
+		id     string
+		name   string
+		parent string
+	}{
+		{"12xvxc345ssdsds-508", elastic.JoinPlan, ""},
+		{"1234vxc2324sdf-501", elastic.JoinPlanCostShares, "12xvxc345ssdsds-508"},
+		{"27283xvx9asdff-504", elastic.JoinLinkedPlanServices, "12xvxc345ssdsds-508"},
+		{"1234520xvc30asdf-502", elastic.JoinLinkedService, "27283xvx9asdff-504"},
+		{"1234512xvc1314asdfs-503", elastic.JoinPlanServiceCostShares, "27283xvx9asdff-504"},
+	}
+	if len(documents) != len(expected) {
+		t.Fatalf("expected %d documents, got %d", len(expected), len(documents))
+	}
+
+	for i, want := range expected {
+		document := documents[i]
+		if document.ID != want.id {
+			t.Errorf("document %d: expected ID %s, got %s", i, want.id, document.ID)
+		}
+		if document.Body["objectId"] != want.id {
+			t.Errorf("document %s: expected objectId %s in body, got %v", want.id, want.id, document.Body["objectId"])
+		}
+
+		planJoin, ok := document.Body["plan_join"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("document %s: plan_join missing", want.id)
+		}
+		if planJoin["name"] != want.name {
+			t.Errorf("document %s: expected join name %s, got %v", want.id, want.name, planJoin["name"])
+		}
+		parent, hasParent := planJoin["parent"]
+		if want.parent == "" && hasParent {
+			t.Errorf("document %s: root plan must not have a parent, got %v", want.id, parent)
+		}
+		if want.parent != "" && parent != want.parent {
+			t.Errorf("document %s: expected parent %s, got %v", want.id, want.parent, parent)
+		}
+	}
+}
+
+func TestDocumentsRouteToRootPlan(t *testing.T) {
+	for _, document := range Documents(testPlan()) {
+		if document.Routing != "12xvxc345ssdsds-508" {
+			t.Errorf("document %s: expected routing by root plan, got %s", document.ID, document.Routing)
+		}
+	}
+}
+
+func TestDocumentsLeaveChildrenOutOfParents(t *testing.T) {
+	documents := Documents(testPlan())
+
+	for _, field := range []string{"planCostShares", "linkedPlanServices"} {
+		if _, ok := documents[0].Body[field]; ok {
+			t.Errorf("plan document must not embed %s", field)
+		}
+	}
+	for _, field := range []string{"linkedService", "planserviceCostShares"} {
+		if _, ok := documents[2].Body[field]; ok {
+			t.Errorf("linkedPlanServices document must not embed %s", field)
+		}
+	}
+}
+
+func TestDocumentsCopyFields(t *testing.T) {
+	documents := Documents(testPlan())
+
+	plan := documents[0].Body
+	if plan["planType"] != "inNetwork" || plan["creationDate"] != "12-12-2017" || plan["_org"] != "example.com" {
+		t.Errorf("unexpected plan body %v", plan)
+	}
+	costShares := documents[1].Body
+	if costShares["copay"] != 23 || costShares["deductible"] != 2000 {
+		t.Errorf("unexpected planCostShares body %v", costShares)
+	}
+	service := documents[3].Body
+	if service["name"] != "Yearly physical" {
+		t.Errorf("unexpected linkedService body %v", service)
+	}
+	serviceCostShares := documents[4].Body
+	if serviceCostShares["copay"] != 0 || serviceCostShares["deductible"] != 10 {
+		t.Errorf("unexpected planserviceCostShares body %v", serviceCostShares)
+	}
+}
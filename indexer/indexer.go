@@ -0,0 +1,377 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/girish332/bigdata/models"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	actionIndex  = "index"
+	actionDelete = "delete"
+
+	// versionTypeExternal makes Elasticsearch only apply a write whose version is
+	// higher than the version of the stored document
+	versionTypeExternal = "external"
+	// versionTypeExternalGTE also applies a write at the version already stored
+	versionTypeExternalGTE = "external_gte"
+)
+
+var ErrClosed = errors.New("indexer is closed")
+
+// ApplyError lists the documents an Apply call failed to write
+type ApplyError struct {
+	// Total is the number of documents of the call
+	Total int
+	// Failed holds the ID of every failed document along with its error
+	Failed []DocumentError
+}
+
+// DocumentError is the error of one document of an Apply call
+type DocumentError struct {
+	ID  string
+	Err error
+}
+
+func (e *ApplyError) Error() string {
+	failed := make([]string, 0, len(e.Failed))
+	for _, document := range e.Failed {
+		failed = append(failed, document.Err.Error())
+	}
+	return fmt.Sprintf("failed to write %d of %d documents: %s", len(e.Failed), e.Total, strings.Join(failed, "; "))
+}
+
+// IDs returns the IDs of the failed documents
+func (e *ApplyError) IDs() []string {
+	ids := make([]string, 0, len(e.Failed))
+	for _, document := range e.Failed {
+		ids = append(ids, document.ID)
+	}
+	return ids
+}
+
+// Config controls how documents are batched into _bulk requests
+type Config struct {
+	// FlushBytes flushes a batch once its request body reaches this size
+	FlushBytes int
+	// FlushInterval flushes a batch this long after its first document was queued
+	FlushInterval time.Duration
+	// MaxRetries is how often a document that failed with 429 or 5xx is retried
+	MaxRetries int
+	// RetryBackoff is the delay before the first retry, doubled on every further one
+	RetryBackoff time.Duration
+	// BlockedRetryInterval is the delay between the retries of a document rejected
+	// by the write block of a migration. Such documents are retried until the alias
+	// moved to the new index, without counting against MaxRetries.
+	BlockedRetryInterval time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		FlushBytes:           5 << 20,
+		FlushInterval:        100 * time.Millisecond,
+		MaxRetries:           3,
+		RetryBackoff:         200 * time.Millisecond,
+		BlockedRetryInterval: time.Second,
+	}
+}
+
+// Indexer writes the join documents of plans to Elasticsearch. Documents queued by
+// concurrent callers are sent together in one _bulk request, and every caller
+// waits for the outcome of its own documents only.
+type Indexer struct {
+	es    *elasticsearch.Client
+	index string
+	cfg   Config
+
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan *item
+	stopped chan struct{}
+}
+
+// item is one action of a _bulk request along with whoever waits for its outcome
+type item struct {
+	action   string
+	document Document
+	version  int64
+	// versionType is external, or external_gte for repairs
+	versionType string
+	body        []byte
+	attempt     int
+	done        func(err error)
+}
+
+func New(es *elasticsearch.Client, index string, cfg Config) *Indexer {
+	ix := &Indexer{
+		es:      es,
+		index:   index,
+		cfg:     cfg,
+		queue:   make(chan *item, 1024),
+		stopped: make(chan struct{}),
+	}
+	go ix.run()
+	return ix
+}
+
+// IndexPlan indexes every document of the plan at the given version
+func (ix *Indexer) IndexPlan(ctx context.Context, plan models.Plan, version int64) error {
+	return ix.Apply(ctx, version, Documents(plan), nil)
+}
+
+// Apply indexes and deletes the given documents and blocks until every one of
+// them was written. All documents are attempted even if some fail, and an
+// *ApplyError lists the ones that did.
+//
+// Every write carries the version of the plan as an external version. A write
+// for a document that was already written at the same or a newer version is
+// stale, it is skipped and does not count as a failure.
+func (ix *Indexer) Apply(ctx context.Context, version int64, index []Document, remove []Document) error {
+	return ix.apply(ctx, version, versionTypeExternal, index, remove)
+}
+
+// Overwrite is Apply for repairs. It also replaces documents that were written at
+// the same version, whose content drifted from the source of truth.
+func (ix *Indexer) Overwrite(ctx context.Context, version int64, index []Document, remove []Document) error {
+	return ix.apply(ctx, version, versionTypeExternalGTE, index, remove)
+}
+
+func (ix *Indexer) apply(ctx context.Context, version int64, versionType string, index []Document, remove []Document) error {
+	results := make(chan DocumentError, len(index)+len(remove))
+	queue := func(action string, document Document) {
+		it := &item{action: action, document: document, version: version, versionType: versionType}
+		it.done = func(err error) {
+			if err != nil {
+				log.Errorf("Failed to %s document ID=%s with err : %v", action, document.ID, err)
+				err = fmt.Errorf("%s %s: %w", action, document.ID, err)
+			}
+			results <- DocumentError{ID: document.ID, Err: err}
+		}
+		if action == actionIndex {
+			body, err := json.Marshal(document.Body)
+			if err != nil {
+				it.done(err)
+				return
+			}
+			it.body = body
+		}
+		ix.enqueue(it)
+	}
+
+	for _, document := range index {
+		queue(actionIndex, document)
+	}
+	for _, document := range remove {
+		queue(actionDelete, document)
+	}
+
+	failed := make([]DocumentError, 0)
+	for i := 0; i < cap(results); i++ {
+		select {
+		case result := <-results:
+			if result.Err != nil {
+				failed = append(failed, result)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if len(failed) > 0 {
+		return &ApplyError{Total: cap(results), Failed: failed}
+	}
+	return nil
+}
+
+// Close flushes the queued documents and stops the indexer. Documents waiting for
+// a retry fail with ErrClosed.
+func (ix *Indexer) Close() {
+	ix.mu.Lock()
+	if !ix.closed {
+		ix.closed = true
+		close(ix.queue)
+	}
+	ix.mu.Unlock()
+	<-ix.stopped
+}
+
+func (ix *Indexer) enqueue(it *item) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+	if ix.closed {
+		it.done(ErrClosed)
+		return
+	}
+	ix.queue <- it
+}
+
+// run collects queued items into batches and flushes them by size or time
+func (ix *Indexer) run() {
+	defer close(ix.stopped)
+
+	timer := time.NewTimer(ix.cfg.FlushInterval)
+	timer.Stop()
+
+	batch := make([]*item, 0)
+	size := 0
+	flush := func() {
+		timer.Stop()
+		if len(batch) > 0 {
+			ix.flush(batch)
+		}
+		batch = make([]*item, 0)
+		size = 0
+	}
+
+	for {
+		select {
+		case it, ok := <-ix.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch) == 0 {
+				timer.Reset(ix.cfg.FlushInterval)
+			}
+			batch = append(batch, it)
+			size += len(it.body)
+			if size >= ix.cfg.FlushBytes {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// bulkMeta is the action line of a document in a _bulk request
+type bulkMeta struct {
+	Index       string `json:"_index"`
+	ID          string `json:"_id"`
+	Routing     string `json:"routing,omitempty"`
+	Version     int64  `json:"version"`
+	VersionType string `json:"version_type"`
+}
+
+// bulkResponse is the part of the _bulk response needed to settle every item
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// flush sends the batch as one _bulk request and settles every item of it
+func (ix *Indexer) flush(batch []*item) {
+	var body bytes.Buffer
+	for _, it := range batch {
+		// Marshalling plain strings cannot fail
+		meta, _ := json.Marshal(map[string]bulkMeta{
+			it.action: {
+				Index:       ix.index,
+				ID:          it.document.ID,
+				Routing:     it.document.Routing,
+				Version:     it.version,
+				VersionType: it.versionType,
+			},
+		})
+		body.Write(meta)
+		body.WriteByte('\n')
+		if it.action == actionIndex {
+			body.Write(it.body)
+			body.WriteByte('\n')
+		}
+	}
+
+	req := esapi.BulkRequest{
+		Body: bytes.NewReader(body.Bytes()),
+	}
+	res, err := req.Do(context.Background(), ix.es)
+	if err != nil {
+		ix.failAll(batch, err)
+		return
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		ix.failAll(batch, fmt.Errorf("[%s] %s", res.Status(), res.String()))
+		return
+	}
+
+	var blk bulkResponse
+	err = json.NewDecoder(res.Body).Decode(&blk)
+	if err != nil || len(blk.Items) != len(batch) {
+		ix.failAll(batch, fmt.Errorf("unexpected _bulk response: %v", err))
+		return
+	}
+
+	log.Printf("Flushed %d documents to the %s index", len(batch), ix.index)
+	for i, result := range blk.Items {
+		it := batch[i]
+		for _, r := range result {
+			switch {
+			case r.Status < http.StatusMultipleChoices:
+				it.done(nil)
+			case it.action == actionDelete && r.Status == http.StatusNotFound:
+				it.done(nil)
+			case r.Status == http.StatusForbidden && r.Error.Type == "cluster_block_exception":
+				// The index is write blocked while it is migrated, retry until the alias moved
+				ix.retryBlocked(it)
+			case r.Status == http.StatusConflict:
+				// A newer version of the plan was written already, this write is stale
+				log.Printf("Skipped stale %s of document ID=%s at version %d", it.action, it.document.ID, it.version)
+				it.done(nil)
+			default:
+				ix.fail(it, r.Status, fmt.Errorf("[%d] %s: %s", r.Status, r.Error.Type, r.Error.Reason))
+			}
+		}
+	}
+}
+
+// failAll fails every item of a batch whose whole request failed
+func (ix *Indexer) failAll(batch []*item, err error) {
+	log.Errorf("Failed to flush %d documents to the %s index : %v", len(batch), ix.index, err)
+	for _, it := range batch {
+		ix.fail(it, http.StatusServiceUnavailable, err)
+	}
+}
+
+// retryBlocked queues the item again after BlockedRetryInterval, however often
+// it was rejected by the write block already. It fails with ErrClosed once the
+// indexer is closed.
+func (ix *Indexer) retryBlocked(it *item) {
+	time.AfterFunc(ix.cfg.BlockedRetryInterval, func() {
+		ix.enqueue(it)
+	})
+}
+
+// fail queues the item again after a backoff if Elasticsearch was overloaded or
+// unavailable, and otherwise reports the error to its caller
+func (ix *Indexer) fail(it *item, status int, err error) {
+	retryable := status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+	if !retryable || it.attempt >= ix.cfg.MaxRetries {
+		it.done(err)
+		return
+	}
+
+	delay := ix.cfg.RetryBackoff << it.attempt
+	it.attempt++
+	time.AfterFunc(delay, func() {
+		ix.enqueue(it)
+	})
+}
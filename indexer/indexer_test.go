@@ -0,0 +1,199 @@
+package indexer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+// fakeBulk is an Elasticsearch stand in that answers _bulk requests with the
+// status returned by respond for every action
+type fakeBulk struct {
+	mu       sync.Mutex
+	requests [][]string
+	respond  func(action, id string, seen int) int
+	seen     map[string]int
+	versions map[string]string
+}
+
+func (f *fakeBulk) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path != "/_bulk" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ids := make([]string, 0)
+	items := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var meta map[string]bulkMeta
+		if err := json.Unmarshal(scanner.Bytes(), &meta); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for action, m := range meta {
+			if action == actionIndex {
+				scanner.Scan()
+			}
+			f.seen[m.ID]++
+			f.versions[m.ID] = fmt.Sprintf("%d/%s", m.Version, m.VersionType)
+			status := f.respond(action, m.ID, f.seen[m.ID])
+			ids = append(ids, action+" "+m.ID)
+			result := map[string]interface{}{"_id": m.ID, "status": status}
+			if status >= http.StatusMultipleChoices {
+				errorType := "test_exception"
+				if status == http.StatusForbidden {
+					errorType = "cluster_block_exception"
+				}
+				result["error"] = map[string]string{"type": errorType, "reason": fmt.Sprintf("status %d", status)}
+			}
+			items = append(items, map[string]interface{}{action: result})
+		}
+	}
+	f.requests = append(f.requests, ids)
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+}
+
+func newTestIndexer(t *testing.T, respond func(action, id string, seen int) int) (*Indexer, *fakeBulk) {
+	t.Helper()
+	fake := &fakeBulk{respond: respond, seen: map[string]int{}, versions: map[string]string{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.FlushInterval = 20 * time.Millisecond
+	cfg.RetryBackoff = time.Millisecond
+	cfg.BlockedRetryInterval = time.Millisecond
+	ix := New(es, "plans", cfg)
+	t.Cleanup(ix.Close)
+	return ix, fake
+}
+
+func TestApplySendsPlanInOneBulkRequest(t *testing.T) {
+	ix, fake := newTestIndexer(t, func(action, id string, seen int) int {
+		return http.StatusOK
+	})
+
+	plan := testPlan()
+	removed := []Document{{ID: "gone-1", Routing: plan.ObjectId}}
+	if err := ix.Apply(context.Background(), 3, Documents(plan), removed); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+
+	if len(fake.requests) != 1 {
+		t.Fatalf("got %d _bulk requests, want 1", len(fake.requests))
+	}
+	if got, want := len(fake.requests[0]), len(Documents(plan))+1; got != want {
+		t.Errorf("got %d actions, want %d", got, want)
+	}
+	if last := fake.requests[0][len(fake.requests[0])-1]; last != "delete gone-1" {
+		t.Errorf("last action = %q, want the delete of the removed document", last)
+	}
+	for id, version := range fake.versions {
+		if version != "3/external" {
+			t.Errorf("document %s written with version %s, want 3/external", id, version)
+		}
+	}
+}
+
+func TestApplySkipsStaleDocuments(t *testing.T) {
+	ix, _ := newTestIndexer(t, func(action, id string, seen int) int {
+		if id == "12xvxc345ssdsds-508" {
+			return http.StatusConflict
+		}
+		return http.StatusOK
+	})
+
+	if err := ix.IndexPlan(context.Background(), testPlan(), 1); err != nil {
+		t.Errorf("IndexPlan() error = %v, want version conflicts to be skipped", err)
+	}
+}
+
+func TestApplyRetriesOverloadedDocuments(t *testing.T) {
+	ix, fake := newTestIndexer(t, func(action, id string, seen int) int {
+		if id == "27283xvx9asdff-504" && seen < 3 {
+			return http.StatusTooManyRequests
+		}
+		return http.StatusCreated
+	})
+
+	if err := ix.IndexPlan(context.Background(), testPlan(), 1); err != nil {
+		t.Fatalf("IndexPlan() error = %v", err)
+	}
+	if len(fake.requests) != 3 {
+		t.Errorf("got %d _bulk requests, want the original and 2 retries", len(fake.requests))
+	}
+	for _, request := range fake.requests[1:] {
+		if len(request) != 1 || request[0] != "index 27283xvx9asdff-504" {
+			t.Errorf("retry request = %v, want only the overloaded document", request)
+		}
+	}
+}
+
+func TestApplyRetriesWriteBlockedDocuments(t *testing.T) {
+	ix, fake := newTestIndexer(t, func(action, id string, seen int) int {
+		// The index stays write blocked by a migration for longer than MaxRetries
+		// would retry an overloaded document
+		if seen <= 10 {
+			return http.StatusForbidden
+		}
+		return http.StatusOK
+	})
+
+	if err := ix.Apply(context.Background(), 2, nil, Documents(testPlan())); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if len(fake.requests) != 11 {
+		t.Errorf("got %d _bulk requests, want the original and 10 retries", len(fake.requests))
+	}
+}
+
+func TestApplyReportsFailedDocuments(t *testing.T) {
+	ix, fake := newTestIndexer(t, func(action, id string, seen int) int {
+		if id == "1234vxc2324sdf-501" {
+			return http.StatusBadRequest
+		}
+		return http.StatusOK
+	})
+
+	err := ix.IndexPlan(context.Background(), testPlan(), 1)
+	var applyErr *ApplyError
+	if !errors.As(err, &applyErr) || !strings.Contains(err.Error(), "1234vxc2324sdf-501") {
+		t.Fatalf("IndexPlan() error = %v, want an ApplyError naming the rejected document", err)
+	}
+	if ids := applyErr.IDs(); len(ids) != 1 || ids[0] != "1234vxc2324sdf-501" || applyErr.Total != len(Documents(testPlan())) {
+		t.Errorf("failed documents = %v of %d, want only the rejected one", ids, applyErr.Total)
+	}
+	if fake.seen["1234vxc2324sdf-501"] != 1 {
+		t.Errorf("rejected document was sent %d times, want no retry", fake.seen["1234vxc2324sdf-501"])
+	}
+}
+
+func TestDeleteIgnoresMissingDocuments(t *testing.T) {
+	ix, _ := newTestIndexer(t, func(action, id string, seen int) int {
+		return http.StatusNotFound
+	})
+
+	if err := ix.Apply(context.Background(), 2, nil, Documents(testPlan())); err != nil {
+		t.Errorf("Apply() error = %v, want missing documents to be ignored", err)
+	}
+}
@@ -0,0 +1,83 @@
+package indexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/girish332/bigdata/elastic"
+	"time"
+)
+
+const (
+	scanPageSize  = 1000
+	scanKeepAlive = time.Minute
+)
+
+// StoredDocument is a document as it is stored in the index
+type StoredDocument struct {
+	ID      string
+	Routing string
+	Version int64
+	Source  map[string]interface{}
+}
+
+type scrollResponse struct {
+	ScrollID string `json:"_scroll_id"`
+	Hits     struct {
+		Hits []struct {
+			ID      string                 `json:"_id"`
+			Routing string                 `json:"_routing"`
+			Version int64                  `json:"_version"`
+			Source  map[string]interface{} `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// Scan calls fn for every document in the index, in no particular order
+func (ix *Indexer) Scan(ctx context.Context, fn func(document StoredDocument) error) error {
+	size := scanPageSize
+	version := true
+	res, err := esapi.SearchRequest{
+		Index:   []string{ix.index},
+		Scroll:  scanKeepAlive,
+		Size:    &size,
+		Version: &version,
+		Sort:    []string{"_doc"},
+	}.Do(ctx, ix.es)
+
+	scrollID := ""
+	defer func() {
+		if scrollID != "" {
+			res, err := esapi.ClearScrollRequest{ScrollID: []string{scrollID}}.Do(context.Background(), ix.es)
+			if err == nil {
+				res.Body.Close()
+			}
+		}
+	}()
+
+	for {
+		if err != nil {
+			return err
+		}
+		var page scrollResponse
+		err = elastic.DecodeResponse(res, &page)
+		if err != nil {
+			return err
+		}
+		scrollID = page.ScrollID
+		if len(page.Hits.Hits) == 0 {
+			return nil
+		}
+
+		for _, hit := range page.Hits.Hits {
+			err := fn(StoredDocument{ID: hit.ID, Routing: hit.Routing, Version: hit.Version, Source: hit.Source})
+			if err != nil {
+				return err
+			}
+		}
+
+		body, _ := json.Marshal(map[string]string{"scroll": scanKeepAlive.String(), "scroll_id": scrollID})
+		res, err = esapi.ScrollRequest{Body: bytes.NewReader(body)}.Do(ctx, ix.es)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/girish332/bigdata/indexer"
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/rabbitmq"
+	"log"
+
+	"github.com/streadway/amqp"
+)
+
+// errUnknownOperation is not retried, no later attempt will understand the event
+var errUnknownOperation = errors.New("unknown operation")
+
+// channel republishes failed messages, as *amqp.Channel does
+type channel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// processDelivery handles one message of the plan queue and always settles it. A
+// failed message is moved to the retry queue of its attempt, or to the dead letter
+// queue once it ran out of attempts or cannot be processed at all.
+func processDelivery(ch channel, ix *indexer.Indexer, d amqp.Delivery) {
+	log.Printf("Received a message: %s", d.Body)
+
+	// Deserialize the event envelope
+	var event models.PlanEvent
+	err := json.Unmarshal(d.Body, &event)
+	if err != nil {
+		deadLetter(ch, d, d.Body, fmt.Errorf("failed to deserialize PlanEvent: %w", err))
+		return
+	}
+
+	err = handleEvent(context.Background(), ix, event)
+	if err != nil {
+		log.Printf("Error handling %s event %s of plan ID=%s version %d: %s", event.Operation, event.EventId, event.ObjectId, event.Version, err)
+		if errors.Is(err, errUnknownOperation) {
+			deadLetter(ch, d, d.Body, err)
+			return
+		}
+		retry(ch, d, failedDocuments(d, event, err), err)
+		return
+	}
+
+	log.Printf("Handled %s event %s of plan ID=%s version %d", event.Operation, event.EventId, event.ObjectId, event.Version)
+	if err := d.Ack(false); err != nil {
+		log.Printf("Failed to ack message %s: %s", d.MessageId, err)
+	}
+}
+
+// handleEvent applies a plan event to the search index. Documents are written with
+// the version of the event, so a late or replayed event never overwrites the
+// documents of a newer version of the plan.
+func handleEvent(ctx context.Context, ix *indexer.Indexer, event models.PlanEvent) error {
+	switch event.Operation {
+	case models.OperationCreate, models.OperationUpdate, models.OperationPatch:
+		// Index the plan and all of its child documents, and drop the documents of
+		// child objects the write removed, in the same bulk request
+		removed := make([]indexer.Document, 0, len(event.Removed))
+		for _, objectId := range event.Removed {
+			removed = append(removed, indexer.Document{ID: objectId, Routing: event.ObjectId})
+		}
+		return ix.Apply(ctx, event.Version, only(indexer.Documents(event.Payload), event.Documents), only(removed, event.Documents))
+	case models.OperationDelete:
+		// Remove the plan and all of its child documents
+		return ix.Apply(ctx, event.Version, nil, only(indexer.Documents(event.Payload), event.Documents))
+	default:
+		return fmt.Errorf("%w %q", errUnknownOperation, event.Operation)
+	}
+}
+
+// only keeps the documents whose ID is listed in ids, or all of them when ids is empty
+func only(documents []indexer.Document, ids []string) []indexer.Document {
+	if len(ids) == 0 {
+		return documents
+	}
+	listed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		listed[id] = true
+	}
+	kept := make([]indexer.Document, 0, len(ids))
+	for _, document := range documents {
+		if listed[document.ID] {
+			kept = append(kept, document)
+		}
+	}
+	return kept
+}
+
+// failedDocuments returns the body a failed event is retried or dead lettered
+// with. When the indexer reports which documents failed, the event is narrowed
+// to them, so documents that were written are not sent again and a dead letter
+// names the documents that never made it.
+func failedDocuments(d amqp.Delivery, event models.PlanEvent, err error) []byte {
+	var applyErr *indexer.ApplyError
+	if !errors.As(err, &applyErr) {
+		return d.Body
+	}
+	event.Documents = applyErr.IDs()
+	body, err := json.Marshal(event)
+	if err != nil {
+		return d.Body
+	}
+	return body
+}
+
+// retry republishes the message with the given body to the retry queue of its
+// next attempt, whose expiry sends it back to the plan queue after the backoff delay
+func retry(ch channel, d amqp.Delivery, body []byte, cause error) {
+	attempt := rabbitmq.Attempt(d.Headers)
+	if attempt >= len(rabbitmq.RetryDelays) {
+		deadLetter(ch, d, body, fmt.Errorf("giving up after %d attempts: %w", attempt+1, cause))
+		return
+	}
+
+	log.Printf("Retrying message %s in %s", d.MessageId, rabbitmq.RetryDelays[attempt])
+	err := ch.Publish(
+		rabbitmq.PlanRetryExchange,   // exchange
+		rabbitmq.RetryQueue(attempt), // routing key
+		false,                        // mandatory
+		false,                        // immediate
+		republished(d, body, attempt+1, cause),
+	)
+	settle(d, err)
+}
+
+// deadLetter parks the message with the given body on the dead letter queue for inspection
+func deadLetter(ch channel, d amqp.Delivery, body []byte, cause error) {
+	log.Printf("Dead lettering message %s: %s", d.MessageId, cause)
+	err := ch.Publish(
+		"",                           // exchange
+		rabbitmq.PlanDeadLetterQueue, // routing key
+		false,                        // mandatory
+		false,                        // immediate
+		republished(d, body, rabbitmq.Attempt(d.Headers), cause),
+	)
+	settle(d, err)
+}
+
+// republished copies a delivery with the given body into a new persistent message
+// carrying the attempt and last error
+func republished(d amqp.Delivery, body []byte, attempt int, cause error) amqp.Publishing {
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	headers[rabbitmq.AttemptHeader] = int32(attempt)
+	headers[rabbitmq.ErrorHeader] = cause.Error()
+
+	return amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Timestamp:    d.Timestamp,
+		Type:         d.Type,
+		Body:         body,
+	}
+}
+
+// settle acks the delivery once its copy was published, and requeues it if the
+// copy could not be published so the message is never lost
+func settle(d amqp.Delivery, publishErr error) {
+	if publishErr != nil {
+		log.Printf("Failed to republish message %s, requeueing it: %s", d.MessageId, publishErr)
+		if err := d.Nack(false, true); err != nil {
+			log.Printf("Failed to nack message %s: %s", d.MessageId, err)
+		}
+		return
+	}
+	if err := d.Ack(false); err != nil {
+		log.Printf("Failed to ack message %s: %s", d.MessageId, err)
+	}
+}
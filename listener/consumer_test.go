@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/girish332/bigdata/indexer"
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/rabbitmq"
+	"github.com/streadway/amqp"
+)
+
+// published is one message republished through the fakeChannel
+type published struct {
+	exchange, key string
+	msg           amqp.Publishing
+}
+
+// fakeChannel records republished messages and fails them with err
+type fakeChannel struct {
+	published []published
+	err       error
+}
+
+func (f *fakeChannel) Publish(exchange, key string, _, _ bool, msg amqp.Publishing) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.published = append(f.published, published{exchange: exchange, key: key, msg: msg})
+	return nil
+}
+
+// settlement records how a delivery was settled
+type settlement struct {
+	acked, nacked, requeued bool
+}
+
+func (s *settlement) Ack(uint64, bool) error { s.acked = true; return nil }
+
+func (s *settlement) Nack(_ uint64, _, requeue bool) error {
+	s.nacked, s.requeued = true, requeue
+	return nil
+}
+
+func (s *settlement) Reject(_ uint64, requeue bool) error { return s.Nack(0, false, requeue) }
+
+func TestRetryCountsAttemptsAndDeadLetters(t *testing.T) {
+	last := len(rabbitmq.RetryDelays)
+	tests := map[string]struct {
+		attempt     interface{}
+		key         string
+		wantAttempt int32
+	}{
+		"first failure":          {attempt: nil, key: rabbitmq.RetryQueue(0), wantAttempt: 1},
+		"int32 header":           {attempt: int32(2), key: rabbitmq.RetryQueue(2), wantAttempt: 3},
+		"int64 header":           {attempt: int64(last - 1), key: rabbitmq.RetryQueue(last - 1), wantAttempt: int32(last)},
+		"out of attempts":        {attempt: int32(last), key: rabbitmq.PlanDeadLetterQueue, wantAttempt: int32(last)},
+		"unreadable header type": {attempt: "3", key: rabbitmq.RetryQueue(0), wantAttempt: 1},
+	}
+	for name, tt := range tests {
+		headers := amqp.Table{"x-trace": "abc"}
+		if tt.attempt != nil {
+			headers[rabbitmq.AttemptHeader] = tt.attempt
+		}
+		ack := &settlement{}
+		d := amqp.Delivery{Acknowledger: ack, Headers: headers, MessageId: "m-1", Body: []byte(`{"objectId": "plan-1"}`)}
+		ch := &fakeChannel{}
+
+		retry(ch, d, []byte(`{"documents": ["pcs-1"]}`), errors.New("[503] unavailable"))
+
+		if len(ch.published) != 1 {
+			t.Errorf("%s: published %d messages, want 1", name, len(ch.published))
+			continue
+		}
+		got := ch.published[0]
+		if got.key != tt.key {
+			t.Errorf("%s: routed to %s, want %s", name, got.key, tt.key)
+		}
+		if got.msg.Headers[rabbitmq.AttemptHeader] != tt.wantAttempt {
+			t.Errorf("%s: attempt header = %v, want %d", name, got.msg.Headers[rabbitmq.AttemptHeader], tt.wantAttempt)
+		}
+		cause, _ := got.msg.Headers[rabbitmq.ErrorHeader].(string)
+		if !strings.Contains(cause, "[503] unavailable") {
+			t.Errorf("%s: error header = %q, want the cause", name, cause)
+		}
+		if tt.key == rabbitmq.PlanDeadLetterQueue && (got.exchange != "" || !strings.Contains(cause, "giving up after")) {
+			t.Errorf("%s: dead letter went to exchange %q with error %q", name, got.exchange, cause)
+		}
+		if tt.key != rabbitmq.PlanDeadLetterQueue && got.exchange != rabbitmq.PlanRetryExchange {
+			t.Errorf("%s: retry went to exchange %q, want %s", name, got.exchange, rabbitmq.PlanRetryExchange)
+		}
+		if string(got.msg.Body) != `{"documents": ["pcs-1"]}` || got.msg.Headers["x-trace"] != "abc" || got.msg.MessageId != "m-1" || got.msg.DeliveryMode != amqp.Persistent {
+			t.Errorf("%s: republished %+v, want a persistent copy with the new body", name, got.msg)
+		}
+		if d.Headers[rabbitmq.ErrorHeader] != nil {
+			t.Errorf("%s: the headers of the delivery were changed", name)
+		}
+		if !ack.acked || ack.nacked {
+			t.Errorf("%s: settled %+v, want the delivery acked", name, *ack)
+		}
+	}
+}
+
+func TestSettleRequeuesWhenTheRepublishFails(t *testing.T) {
+	for name, republish := range map[string]func(ch channel, d amqp.Delivery){
+		"retry":       func(ch channel, d amqp.Delivery) { retry(ch, d, d.Body, errors.New("failed")) },
+		"dead letter": func(ch channel, d amqp.Delivery) { deadLetter(ch, d, d.Body, errors.New("failed")) },
+	} {
+		ack := &settlement{}
+		republish(&fakeChannel{err: amqp.ErrClosed}, amqp.Delivery{Acknowledger: ack, Body: []byte(`{}`)})
+		if ack.acked || !ack.nacked || !ack.requeued {
+			t.Errorf("%s: settled %+v, want a nack with requeue", name, *ack)
+		}
+	}
+}
+
+func TestProcessDeliveryDeadLettersUnreadableEvents(t *testing.T) {
+	for name, body := range map[string]string{
+		"not JSON":          `{"objectId": `,
+		"unknown operation": `{"objectId": "plan-1", "operation": "merge"}`,
+	} {
+		ack := &settlement{}
+		ch := &fakeChannel{}
+		processDelivery(ch, nil, amqp.Delivery{Acknowledger: ack, Body: []byte(body)})
+		if len(ch.published) != 1 || ch.published[0].key != rabbitmq.PlanDeadLetterQueue || string(ch.published[0].msg.Body) != body {
+			t.Errorf("%s: published %+v, want the event on the dead letter queue", name, ch.published)
+		}
+		if !ack.acked {
+			t.Errorf("%s: settled %+v, want the delivery acked", name, *ack)
+		}
+	}
+}
+
+func TestFailedDocumentsNarrowsTheEvent(t *testing.T) {
+	event := models.PlanEvent{Operation: models.OperationUpdate, ObjectId: "plan-1", Version: 4, Removed: []string{"gone-1"}}
+	body, _ := json.Marshal(event)
+	d := amqp.Delivery{Body: body}
+
+	if got := failedDocuments(d, event, errors.New("connection refused")); string(got) != string(body) {
+		t.Errorf("failedDocuments() of a plain error = %s, want the original body", got)
+	}
+
+	applyErr := &indexer.ApplyError{Total: 6, Failed: []indexer.DocumentError{
+		{ID: "pcs-1", Err: errors.New("[400] mapper_parsing_exception")},
+		{ID: "gone-1", Err: errors.New("[503] unavailable")},
+	}}
+	var narrowed models.PlanEvent
+	if err := json.Unmarshal(failedDocuments(d, event, applyErr), &narrowed); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"pcs-1", "gone-1"}; !reflect.DeepEqual(narrowed.Documents, want) {
+		t.Errorf("documents = %v, want %v", narrowed.Documents, want)
+	}
+	narrowed.Documents = nil
+	if !reflect.DeepEqual(narrowed, event) {
+		t.Errorf("narrowed event = %+v, want %+v apart from the documents", narrowed, event)
+	}
+}
+
+func TestOnlyKeepsListedDocuments(t *testing.T) {
+	documents := []indexer.Document{{ID: "plan-1"}, {ID: "pcs-1"}, {ID: "lps-1"}}
+
+	if got := only(documents, nil); !reflect.DeepEqual(got, documents) {
+		t.Errorf("only() without ids = %v, want every document", got)
+	}
+	if got := only(documents, []string{"lps-1", "gone-1"}); !reflect.DeepEqual(got, []indexer.Document{{ID: "lps-1"}}) {
+		t.Errorf("only() = %v, want lps-1", got)
+	}
+}
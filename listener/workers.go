@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/girish332/bigdata/indexer"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultWorkers = 8
+	// defaultPrefetchPerWorker keeps every worker busy while it settles its previous message
+	defaultPrefetchPerWorker = 4
+)
+
+// config holds the tuning knobs of the listener read from the environment
+type config struct {
+	// Workers is the number of goroutines indexing plans in parallel (LISTENER_WORKERS)
+	Workers int
+	// Prefetch is the number of unacknowledged messages RabbitMQ hands to the listener (LISTENER_PREFETCH)
+	Prefetch int
+	// Bulk batches the documents of all workers into _bulk requests
+	// (LISTENER_BULK_FLUSH_BYTES, LISTENER_BULK_FLUSH_INTERVAL)
+	Bulk indexer.Config
+}
+
+func loadConfig() config {
+	workers := envInt("LISTENER_WORKERS", defaultWorkers)
+	bulk := indexer.DefaultConfig()
+	bulk.FlushBytes = envInt("LISTENER_BULK_FLUSH_BYTES", bulk.FlushBytes)
+	bulk.FlushInterval = envDuration("LISTENER_BULK_FLUSH_INTERVAL", bulk.FlushInterval)
+	return config{
+		Workers:  workers,
+		Prefetch: envInt("LISTENER_PREFETCH", workers*defaultPrefetchPerWorker),
+		Bulk:     bulk,
+	}
+}
+
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		log.Printf("Ignoring invalid %s=%q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("Ignoring invalid %s=%q, using %s", name, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// pool hands deliveries to a fixed set of workers. All events of a plan go to the
+// same worker, so they are handled in the order they were delivered, while
+// different plans are handled in parallel.
+type pool struct {
+	queues []chan amqp.Delivery
+	wg     sync.WaitGroup
+}
+
+// newPool starts the workers, each with a queue of buffer deliveries so one busy
+// worker does not hold up the deliveries of the others. The prefetch spread over
+// the workers is a good buffer, as RabbitMQ never hands out more than that.
+func newPool(workers, buffer int, handle func(d amqp.Delivery)) *pool {
+	if buffer < 1 {
+		buffer = 1
+	}
+	p := &pool{queues: make([]chan amqp.Delivery, workers)}
+	for i := range p.queues {
+		queue := make(chan amqp.Delivery, buffer)
+		p.queues[i] = queue
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for d := range queue {
+				handle(d)
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch queues the delivery for the worker owning its plan. It only blocks
+// while the queue of that worker is full.
+func (p *pool) dispatch(d amqp.Delivery) {
+	p.queues[p.worker(d)] <- d
+}
+
+// close stops the workers once they handled every dispatched delivery
+func (p *pool) close() {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+	p.wg.Wait()
+}
+
+// worker picks the worker by the objectId of the plan. Messages that are not a
+// plan event all go to the first worker, which dead letters them.
+func (p *pool) worker(d amqp.Delivery) int {
+	var key struct {
+		ObjectId string `json:"objectId"`
+	}
+	if err := json.Unmarshal(d.Body, &key); err != nil || key.ObjectId == "" {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key.ObjectId))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
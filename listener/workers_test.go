@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func delivery(objectId string, seq int) amqp.Delivery {
+	return amqp.Delivery{MessageId: strconv.Itoa(seq), Body: []byte(fmt.Sprintf(`{"objectId": %q}`, objectId))}
+}
+
+func TestPoolKeepsPlanOrderAndRunsPlansInParallel(t *testing.T) {
+	var mu sync.Mutex
+	handled := map[string][]string{}
+	release := make(chan struct{})
+	done := make(chan string, 16)
+
+	p := newPool(4, 2, func(d amqp.Delivery) {
+		objectId := strings.Split(string(d.Body), `"`)[3]
+		if objectId == "plan-a" && d.MessageId == "1" {
+			// The first event of plan-a keeps its worker busy
+			<-release
+		}
+		mu.Lock()
+		handled[objectId] = append(handled[objectId], d.MessageId)
+		mu.Unlock()
+		done <- objectId
+	})
+
+	// plan-b is owned by another worker than plan-a
+	other := ""
+	for i := 0; other == ""; i++ {
+		candidate := fmt.Sprintf("plan-%d", i)
+		if p.worker(delivery(candidate, 0)) != p.worker(delivery("plan-a", 0)) {
+			other = candidate
+		}
+	}
+
+	go func() {
+		p.dispatch(delivery("plan-a", 1))
+		p.dispatch(delivery("plan-a", 2))
+		for seq := 1; seq <= 3; seq++ {
+			p.dispatch(delivery(other, seq))
+		}
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case objectId := <-done:
+			if objectId != other {
+				t.Fatalf("handled %s while plan-a is blocked, want only %s", objectId, other)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s was not handled while the worker of plan-a was busy", other)
+		}
+	}
+
+	close(release)
+	p.close()
+	want := map[string][]string{"plan-a": {"1", "2"}, other: {"1", "2", "3"}}
+	if !reflect.DeepEqual(handled, want) {
+		t.Errorf("handled = %v, want %v", handled, want)
+	}
+}
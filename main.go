@@ -1,15 +1,50 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"github.com/girish332/bigdata/cmd"
 	routerPkg "github.com/girish332/bigdata/router"
 	"log"
+	"os"
 )
 
 func main() {
+	args := os.Args[1:]
+	if len(args) == 0 || args[0] == "serve" {
+		serve()
+		return
+	}
+
+	var err error
+	switch args[0] {
+	case "index":
+		err = cmd.Index(context.Background(), args[1:], os.Stdout)
+	case "reindex":
+		err = cmd.Reindex(context.Background(), args[1:], os.Stdout)
+	case "check":
+		err = cmd.Check(context.Background(), args[1:], os.Stdout)
+	default:
+		os.Stderr.WriteString(cmd.Usage)
+		err = cmd.ErrUsage
+	}
+	if errors.Is(err, cmd.ErrUsage) {
+		os.Exit(2)
+	}
+	if errors.Is(err, cmd.ErrInconsistent) {
+		log.Print(err)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %v", args[0], err)
+	}
+}
+
+func serve() {
 	router := routerPkg.InitializeRouter()
 	err := router.Run(":8080")
 	if err != nil {
-		log.Println("error starting server: %v", err)
+		log.Printf("error starting server: %v", err)
 		return
 	}
 }
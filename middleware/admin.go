@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+)
+
+// AdminMiddleware only lets through actors listed in the comma separated
+// ADMIN_ACTORS environment variable. It runs after OAuth2Middleware, which sets
+// the actor of the request.
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		actor := c.GetString(ActorKey)
+		for _, admin := range strings.Split(os.Getenv("ADMIN_ACTORS"), ",") {
+			if admin = strings.TrimSpace(admin); admin != "" && admin == actor {
+				c.Next()
+				return
+			}
+		}
+
+		log.Printf("Denied %s %s to %q, not an admin", c.Request.Method, c.FullPath(), actor)
+		c.AbortWithStatusJSON(403, gin.H{"error": "admin access required"})
+	}
+}
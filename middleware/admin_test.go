@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAdminMiddlewareChecksTheActor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("ADMIN_ACTORS", "ops@example.com, admin@example.com")
+
+	tests := map[string]struct {
+		actor string
+		want  int
+	}{
+		"admin":         {"admin@example.com", http.StatusOK},
+		"other actor":   {"user@example.com", http.StatusForbidden},
+		"no actor":      {"", http.StatusForbidden},
+		"partial match": {"ops@example", http.StatusForbidden},
+	}
+	for name, tt := range tests {
+		router := gin.New()
+		router.POST("/schema", func(c *gin.Context) {
+			if tt.actor != "" {
+				c.Set(ActorKey, tt.actor)
+			}
+		}, AdminMiddleware(), func(c *gin.Context) {
+			c.Status(http.StatusOK)
+		})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/schema", nil))
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, tt.want)
+		}
+	}
+}
@@ -8,6 +8,10 @@ import (
 	"strings"
 )
 
+// ActorKey is the context key holding who made the request, taken from the
+// email claim of the ID token or its subject when there is none
+const ActorKey = "actor"
+
 func OAuth2Middleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
@@ -24,12 +28,18 @@ func OAuth2Middleware() gin.HandlerFunc {
 		}
 
 		idToken := strings.TrimPrefix(authHeader, "Bearer ")
-		_, err := idtoken.Validate(c, idToken, clientID)
+		payload, err := idtoken.Validate(c, idToken, clientID)
 		if err != nil {
 			c.AbortWithStatusJSON(401, gin.H{"error": "Invalid token"})
 			log.Println(err.Error())
 			return
 		}
+
+		actor := payload.Subject
+		if email, ok := payload.Claims["email"].(string); ok && email != "" {
+			actor = email
+		}
+		c.Set(ActorKey, actor)
 		c.Next()
 	}
 
@@ -1,12 +1,7 @@
 package models
 
-type SearchRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-}
-
 type PlanCostShares struct {
-	PlanJoin   map[string]interface{} `json:"plan_join,omitempty"`
+	PlanJoin   map[string]interface{} `json:"plan_join,omitempty" es:"-"`
 	Deductible int                    `json:"deductible" binding:"required"`
 	Copay      int                    `json:"copay" binding:"required"`
 	ObjectId   string                 `json:"objectId" binding:"required"`
@@ -15,15 +10,15 @@ type PlanCostShares struct {
 }
 
 type LinkedService struct {
-	PlanJoin   map[string]interface{} `json:"plan_join,omitempty"`
+	PlanJoin   map[string]interface{} `json:"plan_join,omitempty" es:"-"`
 	ObjectId   string                 `json:"objectId" binding:"required"`
 	ObjectType string                 `json:"objectType" binding:"required"`
-	Name       string                 `json:"name" binding:"required"`
+	Name       string                 `json:"name" binding:"required" es:"text,fields.keyword=keyword,fields.suggest=search_as_you_type"`
 	Org        string                 `json:"_org" binding:"required"`
 }
 
 type PlanServiceCostShares struct {
-	PlanJoin   map[string]interface{} `json:"plan_join,omitempty"`
+	PlanJoin   map[string]interface{} `json:"plan_join,omitempty" es:"-"`
 	Deductible int                    `json:"deductible" binding:"required"`
 	Copay      int                    `json:"copay" binding:"required"`
 	ObjectId   string                 `json:"objectId" binding:"required"`
@@ -32,7 +27,7 @@ type PlanServiceCostShares struct {
 }
 
 type LinkedPlanService struct {
-	PlanJoin              map[string]interface{} `json:"plan_join,omitempty"`
+	PlanJoin              map[string]interface{} `json:"plan_join,omitempty" es:"-"`
 	LinkedService         LinkedService          `json:"linkedService" binding:"required"`
 	PlanServiceCostShares PlanServiceCostShares  `json:"planserviceCostShares" binding:"required"`
 	ObjectId              string                 `json:"objectId" binding:"required"`
@@ -41,16 +36,21 @@ type LinkedPlanService struct {
 }
 
 type Plan struct {
-	PlanJoin           map[string]interface{} `json:"plan_join,omitempty"`
+	PlanJoin           map[string]interface{} `json:"plan_join,omitempty" es:"-"`
 	PlanCostShares     PlanCostShares         `json:"planCostShares" binding:"required"`
 	LinkedPlanServices []LinkedPlanService    `json:"linkedPlanServices" binding:"required"`
 	ObjectId           string                 `json:"objectId" binding:"required"`
 	ObjectType         string                 `json:"objectType" binding:"required"`
 	PlanType           string                 `json:"planType" binding:"required"`
-	CreationDate       string                 `json:"creationDate" binding:"required"`
+	CreationDate       string                 `json:"creationDate" binding:"required" es:"date,format=MM-dd-yyyy"`
 	Org                string                 `json:"_org" binding:"required"`
 }
 
+type PlanPage struct {
+	Plans []Plan `json:"plans"`
+	Next  string `json:"next,omitempty"`
+}
+
 func (plan *Plan) UpdatePlan(updatedPlan Plan) {
 	plan.PlanCostShares = updatedPlan.PlanCostShares
 	plan.LinkedPlanServices = updatedPlan.LinkedPlanServices
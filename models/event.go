@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// PlanEventSchemaVersion is bumped whenever the layout of PlanEvent changes
+const PlanEventSchemaVersion = 1
+
+// Operations carried by a PlanEvent
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+	OperationPatch  = "patch"
+	OperationDelete = "delete"
+)
+
+// PlanEvent is the envelope published on the plan_queue for every plan write
+type PlanEvent struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	EventId       string `json:"eventId"`
+	Operation     string `json:"operation"`
+	ObjectId      string `json:"objectId"`
+	// Version of the plan after this write, it increases with every write of the
+	// plan including its deletion
+	Version   int64     `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Actor     string    `json:"actor,omitempty"`
+	// Payload is the plan as written, or the deleted plan for a delete
+	Payload Plan `json:"payload"`
+	// Removed lists the objectIds of child objects an update or patch dropped
+	Removed []string `json:"removed,omitempty"`
+	// Documents is set by the listener when it retries or dead letters an event
+	// of which only some documents failed. It lists the objectIds of the failed
+	// documents, the only ones written again. An empty list means all of them.
+	Documents []string `json:"documents,omitempty"`
+}
@@ -0,0 +1,131 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/rabbitmq"
+	"github.com/girish332/bigdata/repository"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"time"
+)
+
+const (
+	// Key is the Redis list holding plan events that were not delivered to RabbitMQ yet
+	Key = "outbox:plan_events"
+
+	defaultBatchSize    = 100
+	defaultPollInterval = time.Second
+)
+
+// Enqueue queues the event on the outbox as part of the write transaction, so the
+// event is stored if and only if the plan write itself is applied.
+func Enqueue(tx repository.RedisTx, event models.PlanEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	tx.RPush(Key, string(value))
+	return nil
+}
+
+// Relay delivers the outbox to plan_queue in order. An entry is only removed once
+// the broker confirmed it, so an event is published at least once and may be
+// published again if the relay stops between the confirm and the removal.
+// Publisher sends a message and returns once the broker confirmed it, as
+// rabbitmq.Publisher does
+type Publisher interface {
+	Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error
+}
+
+type Relay struct {
+	repo         repository.RedisRepo
+	publisher    Publisher
+	batchSize    int64
+	pollInterval time.Duration
+	wake         chan struct{}
+}
+
+func NewRelay(repo repository.RedisRepo, publisher Publisher) *Relay {
+	return &Relay{
+		repo:         repo,
+		publisher:    publisher,
+		batchSize:    defaultBatchSize,
+		pollInterval: defaultPollInterval,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay up after an event was enqueued instead of waiting for
+// the next poll. It never blocks.
+func (r *Relay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers the outbox until ctx is cancelled. Entries that fail to publish
+// stay at the head of the outbox and are retried on the next poll.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		err := r.drain(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("Error relaying the outbox to RabbitMQ : %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// drain publishes outbox entries until the outbox is empty or a publish fails
+func (r *Relay) drain(ctx context.Context) error {
+	for {
+		entries, err := r.repo.LRange(ctx, Key, 0, r.batchSize-1)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			return nil
+		}
+
+		for _, entry := range entries {
+			err := r.deliver(ctx, entry)
+			if err != nil {
+				return err
+			}
+			// Removes the oldest copy, which is the one that was just delivered
+			err = r.repo.LRem(ctx, Key, 1, entry)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (r *Relay) deliver(ctx context.Context, entry string) error {
+	var event models.PlanEvent
+	err := json.Unmarshal([]byte(entry), &event)
+	if err != nil {
+		// Still hand it over, the listener dead letters events it cannot parse
+		log.Errorf("Relaying an outbox entry that is not a plan event : %v", err)
+	}
+
+	return r.publisher.Publish(ctx, "", rabbitmq.PlanQueue, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		Type:         event.Operation,
+		MessageId:    event.EventId,
+		Timestamp:    event.Timestamp,
+		Body:         []byte(entry),
+	})
+}
@@ -0,0 +1,95 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/girish332/bigdata/repository"
+	"github.com/streadway/amqp"
+)
+
+// listRepo keeps the outbox list in memory
+type listRepo struct {
+	repository.RedisRepo
+	list []string
+}
+
+func (r *listRepo) LRange(_ context.Context, _ string, start, stop int64) ([]string, error) {
+	if start >= int64(len(r.list)) {
+		return []string{}, nil
+	}
+	if stop >= int64(len(r.list)) {
+		stop = int64(len(r.list)) - 1
+	}
+	return append([]string{}, r.list[start:stop+1]...), nil
+}
+
+func (r *listRepo) LRem(_ context.Context, _ string, count int64, value string) error {
+	for i, entry := range r.list {
+		if entry == value {
+			r.list = append(r.list[:i], r.list[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+// failingPublisher fails its failOn-th call and records, for every call, the
+// body and whether the entry was still in the outbox while it was published
+type failingPublisher struct {
+	repo      *listRepo
+	failOn    int
+	calls     int
+	published []string
+	stored    []bool
+}
+
+func (p *failingPublisher) Publish(_ context.Context, _, _ string, msg amqp.Publishing) error {
+	p.calls++
+	if p.calls == p.failOn {
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, string(msg.Body))
+	stored := false
+	for _, entry := range p.repo.list {
+		stored = stored || entry == string(msg.Body)
+	}
+	p.stored = append(p.stored, stored)
+	return nil
+}
+
+func TestDrainRemovesOnlyConfirmedEntriesInOrder(t *testing.T) {
+	repo := &listRepo{list: []string{`{"eventId": "1"}`, `{"eventId": "2"}`, `{"eventId": "3"}`, `{"eventId": "4"}`}}
+	publisher := &failingPublisher{repo: repo, failOn: 3}
+	relay := NewRelay(repo, publisher)
+	relay.batchSize = 2
+
+	if err := relay.drain(context.Background()); err == nil {
+		t.Fatal("drain() error = nil, want the failed publish")
+	}
+	if want := []string{`{"eventId": "1"}`, `{"eventId": "2"}`}; !reflect.DeepEqual(publisher.published, want) {
+		t.Errorf("published = %v, want %v", publisher.published, want)
+	}
+	// The failed entry and everything after it stay in the outbox, in order
+	if want := []string{`{"eventId": "3"}`, `{"eventId": "4"}`}; !reflect.DeepEqual(repo.list, want) {
+		t.Errorf("outbox = %v, want %v", repo.list, want)
+	}
+
+	if err := relay.drain(context.Background()); err != nil {
+		t.Fatalf("second drain() error = %v", err)
+	}
+	want := []string{`{"eventId": "1"}`, `{"eventId": "2"}`, `{"eventId": "3"}`, `{"eventId": "4"}`}
+	if !reflect.DeepEqual(publisher.published, want) {
+		t.Errorf("published = %v, want %v", publisher.published, want)
+	}
+	if len(repo.list) != 0 {
+		t.Errorf("outbox = %v, want it empty", repo.list)
+	}
+	for i, stored := range publisher.stored {
+		if !stored {
+			t.Errorf("entry %s was removed before its publish was confirmed", publisher.published[i])
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package patch
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestJSONPatchAppendix runs the examples of RFC 6902 appendix A
+func TestJSONPatchAppendix(t *testing.T) {
+	tests := map[string]struct {
+		doc, patch, want string
+		err              error
+	}{
+		"A.1 adding an object member": {
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			want:  `{"baz": "qux", "foo": "bar"}`,
+		},
+		"A.2 adding an array element": {
+			doc:   `{"foo": ["bar", "baz"]}`,
+			patch: `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			want:  `{"foo": ["bar", "qux", "baz"]}`,
+		},
+		"A.3 removing an object member": {
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "remove", "path": "/baz"}]`,
+			want:  `{"foo": "bar"}`,
+		},
+		"A.4 removing an array element": {
+			doc:   `{"foo": ["bar", "qux", "baz"]}`,
+			patch: `[{"op": "remove", "path": "/foo/1"}]`,
+			want:  `{"foo": ["bar", "baz"]}`,
+		},
+		"A.5 replacing a value": {
+			doc:   `{"baz": "qux", "foo": "bar"}`,
+			patch: `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			want:  `{"baz": "boo", "foo": "bar"}`,
+		},
+		"A.6 moving a value": {
+			doc:   `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			patch: `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			want:  `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		"A.7 moving an array element": {
+			doc:   `{"foo": ["all", "grass", "cows", "eat"]}`,
+			patch: `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			want:  `{"foo": ["all", "cows", "eat", "grass"]}`,
+		},
+		"A.8 testing a value: success": {
+			doc: `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			patch: `[{"op": "test", "path": "/baz", "value": "qux"},
+				{"op": "test", "path": "/foo/1", "value": 2}]`,
+			want: `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		},
+		"A.9 testing a value: error": {
+			doc:   `{"baz": "qux"}`,
+			patch: `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			err:   ErrTestFailed,
+		},
+		"A.10 adding a nested member object": {
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			want:  `{"foo": "bar", "child": {"grandchild": {}}}`,
+		},
+		"A.11 ignoring unrecognized elements": {
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			want:  `{"foo": "bar", "baz": "qux"}`,
+		},
+		"A.12 adding to a nonexistent target": {
+			doc:   `{"foo": "bar"}`,
+			patch: `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+			err:   ErrInvalidPath,
+		},
+		"A.14 ~ escape ordering": {
+			doc:   `{"/": 9, "~1": 10}`,
+			patch: `[{"op": "test", "path": "/~01", "value": 10}]`,
+			want:  `{"/": 9, "~1": 10}`,
+		},
+		"A.15 comparing strings and numbers": {
+			doc:   `{"/": 9, "~1": 10}`,
+			patch: `[{"op": "test", "path": "/~01", "value": "10"}]`,
+			err:   ErrTestFailed,
+		},
+		"A.16 adding an array value": {
+			doc:   `{"foo": ["bar"]}`,
+			patch: `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			want:  `{"foo": ["bar", ["abc", "def"]]}`,
+		},
+	}
+
+	for name, tt := range tests {
+		p, err := DecodeJSONPatch([]byte(tt.patch))
+		if err != nil {
+			t.Errorf("%s: DecodeJSONPatch() error = %v", name, err)
+			continue
+		}
+		got, err := p.Apply([]byte(tt.doc))
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: Apply() error = %v, want %v", name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Apply() error = %v", name, err)
+			continue
+		}
+		if !equalJSON(t, got, []byte(tt.want)) {
+			t.Errorf("%s: Apply() = %s, want %s", name, got, tt.want)
+		}
+	}
+}
+
+func TestJSONPatchFailsAsAWhole(t *testing.T) {
+	p, err := DecodeJSONPatch([]byte(`[
+		{"op": "replace", "path": "/planType", "value": "outOfNetwork"},
+		{"op": "copy", "from": "/planCostShares", "path": "/copy"},
+		{"op": "remove", "path": "/missing"}
+	]`))
+	if err != nil {
+		t.Fatalf("DecodeJSONPatch() error = %v", err)
+	}
+	if _, err := p.Apply([]byte(`{"planType": "inNetwork", "planCostShares": {}}`)); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("Apply() error = %v, want ErrInvalidPath", err)
+	}
+
+	p, err = DecodeJSONPatch([]byte(`[{"op": "move", "from": "/a", "path": "/a/b"}]`))
+	if err != nil {
+		t.Fatalf("DecodeJSONPatch() error = %v", err)
+	}
+	if _, err := p.Apply([]byte(`{"a": {}}`)); !errors.Is(err, ErrInvalidPath) {
+		t.Errorf("Apply() of a move into itself error = %v, want ErrInvalidPath", err)
+	}
+}
+
+func TestDecodeJSONPatchRejectsInvalidDocuments(t *testing.T) {
+	invalid := map[string]string{
+		"not JSON":      `[{"op": "add"`,
+		"not an array":  `{"op": "add", "path": "/a", "value": 1}`,
+		"unknown op":    `[{"op": "merge", "path": "/a"}]`,
+		"missing value": `[{"op": "replace", "path": "/a"}]`,
+		"relative path": `[{"op": "remove", "path": "a"}]`,
+		"relative from": `[{"op": "move", "from": "a", "path": "/b"}]`,
+	}
+	for name, body := range invalid {
+		if _, err := DecodeJSONPatch([]byte(body)); !errors.Is(err, ErrInvalidPatch) {
+			t.Errorf("%s: DecodeJSONPatch() error = %v, want ErrInvalidPatch", name, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package patch
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// MergePatch is an RFC 7396 JSON Merge Patch document.
+//
+// On top of the RFC, an object patch applied to an array of objects that all
+// carry an objectId is merged element wise, keyed by objectId. A null member
+// removes the element with that objectId, an unknown objectId appends a new one.
+//
+//	{"linkedPlanServices": {"27283xvx9asdff-504": null, "27283xvx9sdf-507": {"planserviceCostShares": {"copay": 5}}}}
+//
+// A patch that gives the array itself replaces it as the RFC describes.
+type MergePatch []byte
+
+func (p MergePatch) Apply(doc []byte) ([]byte, error) {
+	patch, err := decode(p)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+	}
+	target, err := decode(doc)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeValue(target, patch))
+}
+
+func mergeValue(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	if targetArray, ok := target.([]interface{}); ok && isKeyedArray(targetArray) {
+		return mergeKeyedArray(targetArray, patchObject)
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+			continue
+		}
+		targetObject[name] = mergeValue(targetObject[name], value)
+	}
+	return targetObject
+}
+
+func mergeKeyedArray(target []interface{}, patch map[string]interface{}) []interface{} {
+	merged := make([]interface{}, 0, len(target)+len(patch))
+	seen := make(map[string]bool, len(target))
+	for _, element := range target {
+		objectId := element.(map[string]interface{})["objectId"].(string)
+		seen[objectId] = true
+
+		value, ok := patch[objectId]
+		if !ok {
+			merged = append(merged, element)
+			continue
+		}
+		if value == nil {
+			continue
+		}
+		merged = append(merged, mergeValue(element, value))
+	}
+
+	// Append new elements in a stable order, the patch object itself has none
+	added := make([]string, 0)
+	for objectId, value := range patch {
+		if !seen[objectId] && value != nil {
+			added = append(added, objectId)
+		}
+	}
+	sort.Strings(added)
+	for _, objectId := range added {
+		element := mergeValue(nil, patch[objectId])
+		if object, ok := element.(map[string]interface{}); ok {
+			if _, ok := object["objectId"]; !ok {
+				object["objectId"] = objectId
+			}
+		}
+		merged = append(merged, element)
+	}
+	return merged
+}
+
+// isKeyedArray reports whether every element of the array is an object with a string objectId
+func isKeyedArray(array []interface{}) bool {
+	for _, element := range array {
+		object, ok := element.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if _, ok := object["objectId"].(string); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// equalJSON reports whether two JSON documents hold the same value
+func equalJSON(t *testing.T, a, b []byte) bool {
+	t.Helper()
+	var x, y interface{}
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatalf("%s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatalf("%s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := map[string]struct {
+		target, patch, want string
+	}{
+		"null deletes a member": {
+			`{"a": "b", "c": "d"}`, `{"a": null}`, `{"c": "d"}`,
+		},
+		"null of a missing member": {
+			`{"a": "b"}`, `{"x": null}`, `{"a": "b"}`,
+		},
+		"nested merge": {
+			`{"planCostShares": {"copay": 23, "deductible": 2000}, "planType": "inNetwork"}`,
+			`{"planCostShares": {"copay": 5, "_org": "example.com"}}`,
+			`{"planCostShares": {"copay": 5, "deductible": 2000, "_org": "example.com"}, "planType": "inNetwork"}`,
+		},
+		"nested null": {
+			`{"a": {"b": "c", "d": "e"}}`, `{"a": {"b": null}}`, `{"a": {"d": "e"}}`,
+		},
+		"object into a scalar": {
+			`{"a": "b"}`, `{"a": {"c": "d"}}`, `{"a": {"c": "d"}}`,
+		},
+		"keyed array replace": {
+			`{"s": [{"objectId": "1", "copay": 1, "name": "x"}, {"objectId": "2", "copay": 2}]}`,
+			`{"s": {"1": {"copay": 10}}}`,
+			`{"s": [{"objectId": "1", "copay": 10, "name": "x"}, {"objectId": "2", "copay": 2}]}`,
+		},
+		"keyed array remove": {
+			`{"s": [{"objectId": "1"}, {"objectId": "2"}, {"objectId": "3"}]}`,
+			`{"s": {"2": null}}`,
+			`{"s": [{"objectId": "1"}, {"objectId": "3"}]}`,
+		},
+		"keyed array add": {
+			`{"s": [{"objectId": "1"}]}`,
+			`{"s": {"4": {"copay": 4}, "3": {"objectId": "3", "copay": 3}}}`,
+			`{"s": [{"objectId": "1"}, {"objectId": "3", "copay": 3}, {"objectId": "4", "copay": 4}]}`,
+		},
+		"keyed array null of a missing element": {
+			`{"s": [{"objectId": "1"}]}`, `{"s": {"9": null}}`, `{"s": [{"objectId": "1"}]}`,
+		},
+		"array replaces an array": {
+			`{"s": [{"objectId": "1"}, {"objectId": "2"}]}`, `{"s": [{"objectId": "3"}]}`, `{"s": [{"objectId": "3"}]}`,
+		},
+		"object patch of an unkeyed array": {
+			`{"s": [1, 2]}`, `{"s": {"a": 1}}`, `{"s": {"a": 1}}`,
+		},
+		"non-object patch replaces the target": {
+			`{"a": "b"}`, `["c"]`, `["c"]`,
+		},
+		"null patch replaces the target": {
+			`{"a": "b"}`, `null`, `null`,
+		},
+		"scalar patch replaces the target": {
+			`{"a": {"b": 1}}`, `"x"`, `"x"`,
+		},
+		"empty patch": {
+			`{"a": "b"}`, `{}`, `{"a": "b"}`,
+		},
+	}
+
+	for name, tt := range tests {
+		got, err := MergePatch(tt.patch).Apply([]byte(tt.target))
+		if err != nil {
+			t.Errorf("%s: Apply() error = %v", name, err)
+			continue
+		}
+		if !equalJSON(t, got, []byte(tt.want)) {
+			t.Errorf("%s: Apply() = %s, want %s", name, got, tt.want)
+		}
+	}
+}
+
+func TestMergePatchRejectsInvalidJSON(t *testing.T) {
+	if _, err := MergePatch(`{"a":`).Apply([]byte(`{}`)); !errors.Is(err, ErrInvalidPatch) {
+		t.Errorf("Apply() error = %v, want ErrInvalidPatch", err)
+	}
+}
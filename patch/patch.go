@@ -0,0 +1,32 @@
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+const (
+	MergePatchContentType = "application/merge-patch+json"
+)
+
+var ErrInvalidPatch = errors.New("invalid patch document")
+
+// Patch transforms a stored JSON document into its patched form
+type Patch interface {
+	Apply(doc []byte) ([]byte, error)
+}
+
+// Func adapts a plain function to the Patch interface
+type Func func(doc []byte) ([]byte, error)
+
+func (f Func) Apply(doc []byte) ([]byte, error) {
+	return f(doc)
+}
+
+func decode(data []byte) (interface{}, error) {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
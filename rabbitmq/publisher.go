@@ -0,0 +1,152 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"sync"
+	"time"
+)
+
+const defaultConfirmTimeout = 5 * time.Second
+
+var ErrUnavailable = errors.New("message broker unavailable")
+
+// Publisher keeps one connection and confirm mode channel open for the lifetime of
+// the process. It reconnects on the next publish after the connection or channel
+// was lost, and every publish waits until the broker confirmed the message.
+type Publisher struct {
+	factory        *Factory
+	confirmTimeout time.Duration
+
+	mu       sync.Mutex
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+	// connClosed and chClosed are registered with NotifyClose of the connection
+	// and the channel. amqp closes every registered chan on shutdown, so each
+	// needs its own
+	connClosed chan *amqp.Error
+	chClosed   chan *amqp.Error
+}
+
+func NewPublisher(factory *Factory) *Publisher {
+	return &Publisher{
+		factory:        factory,
+		confirmTimeout: defaultConfirmTimeout,
+	}
+}
+
+// Publish sends the message and returns once the broker acknowledged it. Failures
+// are reported as ErrUnavailable. Publishes are serialized so every confirmation
+// belongs to the message that was just sent.
+func (p *Publisher) Publish(ctx context.Context, exchange, key string, msg amqp.Publishing) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.connect()
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	err = p.ch.Publish(
+		exchange, // exchange
+		key,      // routing key
+		false,    // mandatory
+		false,    // immediate
+		msg,
+	)
+	if err != nil {
+		p.reset()
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	timer := time.NewTimer(p.confirmTimeout)
+	defer timer.Stop()
+
+	select {
+	case confirm, ok := <-p.confirms:
+		if !ok {
+			p.reset()
+			return fmt.Errorf("%w: channel closed before the message was confirmed", ErrUnavailable)
+		}
+		if !confirm.Ack {
+			return fmt.Errorf("%w: broker rejected the message", ErrUnavailable)
+		}
+		return nil
+	case <-timer.C:
+		// A late confirmation would be taken for the next message, start over
+		p.reset()
+		return fmt.Errorf("%w: no confirmation within %s", ErrUnavailable, p.confirmTimeout)
+	case <-ctx.Done():
+		p.reset()
+		return ctx.Err()
+	}
+}
+
+// Close closes the channel and connection of the publisher
+func (p *Publisher) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reset()
+}
+
+// connect opens the connection and channel unless they are still usable
+func (p *Publisher) connect() error {
+	if p.ch != nil {
+		select {
+		case err := <-p.connClosed:
+			log.Errorf("RabbitMQ connection lost, reconnecting : %v", err)
+			p.reset()
+		case err := <-p.chClosed:
+			log.Errorf("RabbitMQ channel lost, reconnecting : %v", err)
+			p.reset()
+		default:
+			return nil
+		}
+	}
+
+	conn, err := p.factory.NewConnection()
+	if err != nil {
+		return err
+	}
+	ch, err := p.factory.NewChannel(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := DeclareTopology(ch); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn = conn
+	p.ch = ch
+	p.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.connClosed = conn.NotifyClose(make(chan *amqp.Error, 1))
+	p.chClosed = ch.NotifyClose(make(chan *amqp.Error, 1))
+	return nil
+}
+
+// reset closes the channel and connection and drops them with their notify
+// chans. It never closes a notify chan itself, amqp does that on shutdown, and
+// closing an already closed channel or connection only returns an error.
+func (p *Publisher) reset() {
+	if p.ch != nil {
+		p.ch.Close()
+	}
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.conn = nil
+	p.ch = nil
+	p.confirms = nil
+	p.connClosed = nil
+	p.chClosed = nil
+}
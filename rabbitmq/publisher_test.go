@@ -0,0 +1,29 @@
+package rabbitmq
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+// closedNotify returns a notify chan the way amqp leaves it after a shutdown
+func closedNotify() chan *amqp.Error {
+	c := make(chan *amqp.Error, 1)
+	c <- amqp.ErrClosed
+	close(c)
+	return c
+}
+
+func TestResetTwiceAfterShutdown(t *testing.T) {
+	p := NewPublisher(&Factory{})
+	p.confirms = make(chan amqp.Confirmation)
+	p.connClosed = closedNotify()
+	p.chClosed = closedNotify()
+
+	p.reset()
+	p.reset()
+	if p.conn != nil || p.ch != nil || p.confirms != nil || p.connClosed != nil || p.chClosed != nil {
+		t.Errorf("reset() left %+v, want every connection field cleared", p)
+	}
+	p.Close()
+}
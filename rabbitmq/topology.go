@@ -0,0 +1,117 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"github.com/streadway/amqp"
+	"time"
+)
+
+const (
+	PlanQueue = "plan_queue"
+	// PlanRetryExchange routes failed messages to the retry queue of their attempt
+	PlanRetryExchange = "plan_queue.retry"
+	// PlanDeadLetterQueue keeps messages that failed every attempt or cannot be parsed
+	PlanDeadLetterQueue = "plan_queue.dlq"
+
+	// AttemptHeader counts how often a message has already been retried
+	AttemptHeader = "x-attempt"
+	// ErrorHeader carries the last processing error of a dead lettered message
+	ErrorHeader = "x-error"
+)
+
+// RetryDelays are the backoff delays between attempts. A message is dead lettered
+// once it failed len(RetryDelays)+1 times.
+var RetryDelays = []time.Duration{
+	1 * time.Second,
+	2 * time.Second,
+	4 * time.Second,
+	8 * time.Second,
+	16 * time.Second,
+}
+
+// RetryQueue returns the name of the queue that holds a message for the delay of
+// the given retry, starting at 0
+func RetryQueue(retry int) string {
+	return fmt.Sprintf("%s.%dms", PlanRetryExchange, RetryDelays[retry].Milliseconds())
+}
+
+// DeclareTopology declares the durable plan queue, one retry queue per backoff
+// delay and the dead letter queue. Retry queues have no consumers, their messages
+// expire after the delay and are dead lettered back onto the plan queue.
+func DeclareTopology(ch *amqp.Channel) error {
+	_, err := ch.QueueDeclare(
+		PlanQueue, // name
+		true,      // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("declare %s: %w", PlanQueue, err)
+	}
+
+	err = ch.ExchangeDeclare(
+		PlanRetryExchange, // name
+		"direct",          // type
+		true,              // durable
+		false,             // auto-deleted
+		false,             // internal
+		false,             // no-wait
+		nil,               // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("declare %s: %w", PlanRetryExchange, err)
+	}
+
+	for retry, delay := range RetryDelays {
+		name := RetryQueue(retry)
+		_, err = ch.QueueDeclare(
+			name,  // name
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			amqp.Table{
+				"x-message-ttl":             delay.Milliseconds(),
+				"x-dead-letter-exchange":    "",
+				"x-dead-letter-routing-key": PlanQueue,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("declare %s: %w", name, err)
+		}
+
+		err = ch.QueueBind(name, name, PlanRetryExchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("bind %s: %w", name, err)
+		}
+	}
+
+	_, err = ch.QueueDeclare(
+		PlanDeadLetterQueue, // name
+		true,                // durable
+		false,               // delete when unused
+		false,               // exclusive
+		false,               // no-wait
+		nil,                 // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("declare %s: %w", PlanDeadLetterQueue, err)
+	}
+	return nil
+}
+
+// Attempt returns how many times a delivery has been retried so far
+func Attempt(headers amqp.Table) int {
+	switch attempt := headers[AttemptHeader].(type) {
+	case int32:
+		return int(attempt)
+	case int64:
+		return int(attempt)
+	case int:
+		return attempt
+	default:
+		return 0
+	}
+}
@@ -1,13 +1,49 @@
 package repository
 
 import (
-	"github.com/gin-gonic/gin"
+	"context"
+	"errors"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+	ErrTxConflict  = errors.New("transaction aborted, a watched key was modified")
 )
 
 type RedisRepo interface {
-	Ping(c *gin.Context) error
-	Get(c *gin.Context, key string) (string, error)
-	Set(c *gin.Context, key string, value string) error
-	Delete(c *gin.Context, key string) error
-	Keys(c *gin.Context, pattern string) ([]string, error)
+	Ping(c context.Context) error
+	Get(c context.Context, key string) (string, error)
+	MGet(c context.Context, keys ...string) ([]string, error)
+	Set(c context.Context, key string, value string) error
+	SetPersistent(c context.Context, key string, value string) error
+	Delete(c context.Context, key string) error
+	Keys(c context.Context, pattern string) ([]string, error)
+	// Scan returns a batch of about count keys starting at cursor and the cursor
+	// of the next batch, which is 0 once every key was returned
+	Scan(c context.Context, cursor uint64, count int64) ([]string, uint64, error)
+	ZAdd(c context.Context, key string, member string) error
+	ZRem(c context.Context, key string, member string) error
+	ZRangeAfter(c context.Context, key string, after string, count int64) ([]string, error)
+	ZCard(c context.Context, key string) (int64, error)
+	LRange(c context.Context, key string, start int64, stop int64) ([]string, error)
+	LRem(c context.Context, key string, count int64, value string) error
+	// Tx WATCHes the given keys, lets fn read through and queue writes on the
+	// RedisTx, and then applies the queued writes in a single MULTI/EXEC.
+	// ErrTxConflict is returned when a watched key changed in the meantime.
+	Tx(c context.Context, watch []string, fn func(tx RedisTx) error) error
+}
+
+// RedisTx reads the current state and queues writes for a RedisRepo.Tx call.
+// Queued writes are only applied if fn returns nil.
+type RedisTx interface {
+	// Watch adds keys to the watched keys of the transaction, for keys that are
+	// only known after reading others
+	Watch(keys ...string) error
+	Get(key string) (string, error)
+	Set(key string, value string)
+	SetPersistent(key string, value string)
+	Delete(key string)
+	ZAdd(key string, member string)
+	ZRem(key string, member string)
+	RPush(key string, value string)
 }
@@ -1,13 +1,19 @@
 package router
 
 import (
+	"context"
+	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/girish332/bigdata/database"
 	"github.com/girish332/bigdata/elastic"
 	"github.com/girish332/bigdata/handler"
+	"github.com/girish332/bigdata/indexer"
 	"github.com/girish332/bigdata/middleware"
+	"github.com/girish332/bigdata/outbox"
+	"github.com/girish332/bigdata/rabbitmq"
 	"github.com/girish332/bigdata/service"
+	"log"
 )
 
 func InitializeRouter() *gin.Engine {
@@ -16,9 +22,31 @@ func InitializeRouter() *gin.Engine {
 	router.Use(gin.Recovery())
 
 	redisRepo := database.NewRedisRepo("localhost:6379", "")
-	planService := service.NewPlansService(redisRepo)
+	if err := service.BackfillPlanIndex(context.Background(), redisRepo); err != nil {
+		log.Printf("Failed to backfill the plan index: %v", err)
+	}
+	schemaService := service.NewSchemaService(redisRepo)
+	publisher := rabbitmq.NewPublisher(&rabbitmq.Factory{})
+	relay := outbox.NewRelay(redisRepo, publisher)
+	go relay.Run(context.Background())
+	planService := service.NewPlansService(redisRepo, schemaService, relay)
 	esFactory := elastic.NewElasticFactory()
-	planHandler := handler.NewPlansHandler(planService, esFactory)
+	esClient, err := esFactory.NewClient(elasticsearch.Config{
+		Addresses: []string{
+			"http://localhost:9200",
+		},
+	})
+	if err != nil {
+		log.Fatalf("Failed to create the Elasticsearch client: %v", err)
+	}
+	ix := indexer.New(esClient.ES, elastic.PlansAlias, indexer.DefaultConfig())
+	reindexService := service.NewReindexService(redisRepo, ix)
+	consistencyService := service.NewConsistencyService(redisRepo, ix)
+	searchService := service.NewSearchService(redisRepo, esClient.ES, elastic.PlansAlias, elastic.Mapping())
+	planHandler := handler.NewPlansHandler(planService)
+	schemaHandler := handler.NewSchemaHandler(schemaService)
+	adminHandler := handler.NewAdminHandler(reindexService, consistencyService)
+	searchHandler := handler.NewSearchHandler(searchService)
 
 	v1 := router.Group("/v1", middleware.OAuth2Middleware())
 	{
@@ -28,7 +56,21 @@ func InitializeRouter() *gin.Engine {
 		v1.GET("/plans", planHandler.GetAllPlans)
 		v1.PATCH("/plan/:objectId", planHandler.PatchPlan)
 		v1.PUT("/plan", planHandler.UpdatePlan)
-		v1.POST("/search", planHandler.SearchPlans)
+		v1.POST("/search", searchHandler.Search)
+		v1.POST("/search/has-child", searchHandler.HasChild)
+		v1.POST("/search/has-parent", searchHandler.HasParent)
+		v1.POST("/analytics", searchHandler.Analytics)
+		v1.GET("/suggest/services", searchHandler.SuggestServices)
+		v1.GET("/schema/:objectType", schemaHandler.GetSchema)
+	}
+
+	admin := v1.Group("", middleware.AdminMiddleware())
+	{
+		admin.POST("/schema/:objectType", schemaHandler.CreateSchema)
+		admin.POST("/admin/reindex", adminHandler.StartReindex)
+		admin.GET("/admin/reindex", adminHandler.GetReindex)
+		admin.GET("/admin/consistency", adminHandler.CheckConsistency)
+		admin.POST("/admin/consistency/repair", adminHandler.RepairConsistency)
 	}
 
 	return router
@@ -0,0 +1,18 @@
+package schema
+
+import (
+	"embed"
+)
+
+//go:embed defaults/*.json
+var defaults embed.FS
+
+// Default returns the built in schema for an objectType, used until a schema is
+// registered for it
+func Default(objectType string) ([]byte, bool) {
+	raw, err := defaults.ReadFile("defaults/" + objectType + ".json")
+	if err != nil {
+		return nil, false
+	}
+	return raw, true
+}
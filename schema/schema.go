@@ -0,0 +1,213 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var ErrInvalidSchema = errors.New("invalid json schema")
+
+// Schema is the subset of JSON Schema (draft 2020-12 / draft-07) supported by the
+// registry: type, enum, const, properties, required, additionalProperties, items,
+// the numeric, string and array bounds, pattern, format, $ref to local definitions
+// and the allOf, anyOf, oneOf and not combinators. Unknown keywords are ignored.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 stringList         `json:"type,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Const                *interface{}       `json:"const,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	UniqueItems          bool               `json:"uniqueItems,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	ExclusiveMinimum     *float64           `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     *float64           `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	Not                  *Schema            `json:"not,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+	Defs                 map[string]*Schema `json:"$defs,omitempty"`
+
+	// boolean schemas, true accepts and false rejects every value
+	isBool    bool
+	boolValue bool
+
+	pattern *regexp.Regexp
+	ref     *Schema
+}
+
+// stringList accepts either a single string or an array of strings
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*l = stringList{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*l = many
+	return nil
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.Equal(trimmed, []byte("true")) || bytes.Equal(trimmed, []byte("false")) {
+		s.isBool = true
+		s.boolValue = trimmed[0] == 't'
+		return nil
+	}
+
+	type plain Schema
+	return json.Unmarshal(data, (*plain)(s))
+}
+
+// Compile parses a JSON Schema document and checks that every pattern compiles,
+// every $ref points at a definition of the same document and no $ref leads back
+// to the same schema without descending into a property or item.
+func Compile(raw []byte) (*Schema, error) {
+	var root Schema
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if err := decoder.Decode(&root); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	if err := root.compile(&root, ""); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+	return &root, nil
+}
+
+func (s *Schema) compile(root *Schema, pointer string) error {
+	if s == nil || s.isBool {
+		return nil
+	}
+
+	for _, t := range s.Type {
+		switch t {
+		case "object", "array", "string", "number", "integer", "boolean", "null":
+		default:
+			return fmt.Errorf("%s: unknown type %q", pointer, t)
+		}
+	}
+
+	if s.Pattern != "" {
+		pattern, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s/pattern: %v", pointer, err)
+		}
+		s.pattern = pattern
+	}
+
+	if s.Ref != "" {
+		ref, err := root.resolve(s.Ref)
+		if err != nil {
+			return fmt.Errorf("%s/$ref: %v", pointer, err)
+		}
+		s.ref = ref
+		if loops(root, s, map[*Schema]bool{}) {
+			return fmt.Errorf("%s/$ref: %q refers back to itself without descending into the value", pointer, s.Ref)
+		}
+	}
+
+	for name, property := range s.Properties {
+		if err := property.compile(root, pointer+"/properties/"+EscapePointer(name)); err != nil {
+			return err
+		}
+	}
+	for name, definition := range s.Definitions {
+		if err := definition.compile(root, pointer+"/definitions/"+EscapePointer(name)); err != nil {
+			return err
+		}
+	}
+	for name, definition := range s.Defs {
+		if err := definition.compile(root, pointer+"/$defs/"+EscapePointer(name)); err != nil {
+			return err
+		}
+	}
+	for keyword, list := range map[string][]*Schema{"allOf": s.AllOf, "anyOf": s.AnyOf, "oneOf": s.OneOf} {
+		for i, sub := range list {
+			if err := sub.compile(root, fmt.Sprintf("%s/%s/%d", pointer, keyword, i)); err != nil {
+				return err
+			}
+		}
+	}
+	if err := s.AdditionalProperties.compile(root, pointer+"/additionalProperties"); err != nil {
+		return err
+	}
+	if err := s.Items.compile(root, pointer+"/items"); err != nil {
+		return err
+	}
+	return s.Not.compile(root, pointer+"/not")
+}
+
+// resolve looks up a local reference such as #/definitions/service or #/$defs/service
+func (s *Schema) resolve(ref string) (*Schema, error) {
+	if ref == "#" {
+		return s, nil
+	}
+	for prefix, definitions := range map[string]map[string]*Schema{"#/definitions/": s.Definitions, "#/$defs/": s.Defs} {
+		if name, ok := strings.CutPrefix(ref, prefix); ok {
+			if definition, ok := definitions[unescape(name)]; ok {
+				return definition, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("cannot resolve %q, only local definitions are supported", ref)
+}
+
+// loops reports whether s reaches itself again through $ref, allOf, anyOf, oneOf
+// or not. These apply to the same value, so validating such a schema would never
+// end. visiting holds the schemas of the current path.
+func loops(root, s *Schema, visiting map[*Schema]bool) bool {
+	if s == nil || s.isBool {
+		return false
+	}
+	if visiting[s] {
+		return true
+	}
+	visiting[s] = true
+	defer delete(visiting, s)
+
+	next := make([]*Schema, 0, len(s.AllOf)+len(s.AnyOf)+len(s.OneOf)+2)
+	if s.Ref != "" {
+		if ref, err := root.resolve(s.Ref); err == nil {
+			next = append(next, ref)
+		}
+	}
+	next = append(next, s.AllOf...)
+	next = append(next, s.AnyOf...)
+	next = append(next, s.OneOf...)
+	next = append(next, s.Not)
+	for _, sub := range next {
+		if loops(root, sub, visiting) {
+			return true
+		}
+	}
+	return false
+}
+
+// EscapePointer escapes a member name for use as a JSON Pointer reference token
+func EscapePointer(token string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+func unescape(token string) string {
+	return strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+}
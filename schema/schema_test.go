@@ -0,0 +1,71 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCompileRejectsInvalidSchemas(t *testing.T) {
+	tests := map[string]string{
+		"not JSON":            `{`,
+		"unknown type":        `{"type": "date"}`,
+		"bad pattern":         `{"properties": {"a": {"pattern": "("}}}`,
+		"unresolved $ref":     `{"$ref": "#/$defs/missing"}`,
+		"remote $ref":         `{"$ref": "https://example.com/plan.json"}`,
+		"nested in allOf":     `{"allOf": [{}, {"type": "text"}]}`,
+		"nested in items":     `{"items": {"$ref": "#/definitions/x"}}`,
+		"wrong keyword type":  `{"required": "a"}`,
+		"$ref cycle":          `{"$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}, "$ref": "#/$defs/a"}`,
+		"$ref to itself":      `{"$ref": "#"}`,
+		"cycle through allOf": `{"$defs": {"a": {"allOf": [{"$ref": "#/$defs/a"}]}}, "$ref": "#/$defs/a"}`,
+	}
+	for name, raw := range tests {
+		if _, err := Compile([]byte(raw)); !errors.Is(err, ErrInvalidSchema) {
+			t.Errorf("%s: Compile() error = %v, want ErrInvalidSchema", name, err)
+		}
+	}
+}
+
+func TestCompileAcceptsRecursionThroughValues(t *testing.T) {
+	raw := `{"$defs": {"node": {"properties": {"children": {"items": {"$ref": "#/$defs/node"}}}}}, "$ref": "#/$defs/node"}`
+	s, err := Compile([]byte(raw))
+	if err != nil {
+		t.Fatalf("Compile() error = %v", err)
+	}
+	var doc interface{}
+	json.Unmarshal([]byte(`{"children": [{"children": []}]}`), &doc)
+	if errs := s.Validate(doc, ""); len(errs) != 0 {
+		t.Errorf("Validate() = %v, want no errors", errs)
+	}
+}
+
+func TestCompileDefaults(t *testing.T) {
+	raw, ok := Default("plan")
+	if !ok {
+		t.Fatal("Default(plan) is missing")
+	}
+	if _, err := Compile(raw); err != nil {
+		t.Errorf("Compile(plan) error = %v", err)
+	}
+	if _, ok := Default("x"); ok {
+		t.Error("Default(x) exists")
+	}
+}
+
+func TestEscapePointer(t *testing.T) {
+	tests := map[string]string{
+		"copay": "copay",
+		"a/b":   "a~1b",
+		"m~n":   "m~0n",
+		"~1":    "~01",
+	}
+	for token, want := range tests {
+		if got := EscapePointer(token); got != want {
+			t.Errorf("EscapePointer(%q) = %q, want %q", token, got, want)
+		}
+		if got := unescape(want); got != token {
+			t.Errorf("unescape(%q) = %q, want %q", want, got, token)
+		}
+	}
+}
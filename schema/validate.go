@@ -0,0 +1,255 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationError is a single schema violation, located by a JSON Pointer into the document
+type ValidationError struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// Validate checks a decoded JSON document against the schema and returns every
+// violation found. The pointers of the errors are prefixed with base.
+func (s *Schema) Validate(doc interface{}, base string) []ValidationError {
+	v := &validator{}
+	v.validate(s, doc, base)
+	return v.errors
+}
+
+type validator struct {
+	errors []ValidationError
+}
+
+func (v *validator) fail(pointer, format string, args ...interface{}) {
+	v.errors = append(v.errors, ValidationError{Pointer: pointer, Message: fmt.Sprintf(format, args...)})
+}
+
+// valid reports whether value matches s without recording any errors
+func valid(s *Schema, value interface{}) bool {
+	probe := &validator{}
+	probe.validate(s, value, "")
+	return len(probe.errors) == 0
+}
+
+func (v *validator) validate(s *Schema, value interface{}, pointer string) {
+	if s == nil {
+		return
+	}
+	if s.isBool {
+		if !s.boolValue {
+			v.fail(pointer, "is not allowed")
+		}
+		return
+	}
+	if s.ref != nil {
+		v.validate(s.ref, value, pointer)
+	}
+
+	if len(s.Type) > 0 && !matchesType(s.Type, value) {
+		v.fail(pointer, "must be of type %s, got %s", joinTypes(s.Type), typeOf(value))
+		return
+	}
+	if len(s.Enum) > 0 && !containsValue(s.Enum, value) {
+		v.fail(pointer, "must be one of %s", mustMarshal(s.Enum))
+	}
+	if s.Const != nil && !reflect.DeepEqual(*s.Const, value) {
+		v.fail(pointer, "must be %s", mustMarshal(*s.Const))
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(s, value, pointer)
+	case []interface{}:
+		v.validateArray(s, value, pointer)
+	case string:
+		v.validateString(s, value, pointer)
+	case float64:
+		v.validateNumber(s, value, pointer)
+	}
+
+	for _, sub := range s.AllOf {
+		v.validate(sub, value, pointer)
+	}
+	if len(s.AnyOf) > 0 {
+		matched := false
+		for _, sub := range s.AnyOf {
+			if valid(sub, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(pointer, "must match at least one schema of anyOf")
+		}
+	}
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if valid(sub, value) {
+				matches++
+			}
+		}
+		if matches != 1 {
+			v.fail(pointer, "must match exactly one schema of oneOf, matched %d", matches)
+		}
+	}
+	if s.Not != nil && valid(s.Not, value) {
+		v.fail(pointer, "must not match the schema of not")
+	}
+}
+
+func (v *validator) validateObject(s *Schema, object map[string]interface{}, pointer string) {
+	for _, name := range s.Required {
+		if _, ok := object[name]; !ok {
+			v.fail(pointer+"/"+EscapePointer(name), "is required")
+		}
+	}
+
+	// Walk members in a stable order so the error list is deterministic
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		memberPointer := pointer + "/" + EscapePointer(name)
+		if property, ok := s.Properties[name]; ok {
+			v.validate(property, object[name], memberPointer)
+			continue
+		}
+		if s.AdditionalProperties != nil {
+			if s.AdditionalProperties.isBool && !s.AdditionalProperties.boolValue {
+				v.fail(memberPointer, "is not a known property")
+				continue
+			}
+			v.validate(s.AdditionalProperties, object[name], memberPointer)
+		}
+	}
+}
+
+func (v *validator) validateArray(s *Schema, array []interface{}, pointer string) {
+	if s.MinItems != nil && len(array) < *s.MinItems {
+		v.fail(pointer, "must have at least %d items", *s.MinItems)
+	}
+	if s.MaxItems != nil && len(array) > *s.MaxItems {
+		v.fail(pointer, "must have at most %d items", *s.MaxItems)
+	}
+	if s.UniqueItems {
+		for i := range array {
+			for j := 0; j < i; j++ {
+				if reflect.DeepEqual(array[i], array[j]) {
+					v.fail(fmt.Sprintf("%s/%d", pointer, i), "duplicates item %d", j)
+				}
+			}
+		}
+	}
+	for i, item := range array {
+		v.validate(s.Items, item, fmt.Sprintf("%s/%d", pointer, i))
+	}
+}
+
+func (v *validator) validateString(s *Schema, value, pointer string) {
+	length := utf8.RuneCountInString(value)
+	if s.MinLength != nil && length < *s.MinLength {
+		v.fail(pointer, "must be at least %d characters long", *s.MinLength)
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		v.fail(pointer, "must be at most %d characters long", *s.MaxLength)
+	}
+	if s.pattern != nil && !s.pattern.MatchString(value) {
+		v.fail(pointer, "must match pattern %s", s.Pattern)
+	}
+
+	// Unknown formats are annotations only, as the specification allows
+	var err error
+	switch s.Format {
+	case "date":
+		_, err = time.Parse("2006-01-02", value)
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, value)
+	case "time":
+		_, err = time.Parse("15:04:05Z07:00", value)
+	}
+	if err != nil {
+		v.fail(pointer, "must be a valid %s", s.Format)
+	}
+}
+
+func (v *validator) validateNumber(s *Schema, value float64, pointer string) {
+	if s.Minimum != nil && value < *s.Minimum {
+		v.fail(pointer, "must be >= %v", *s.Minimum)
+	}
+	if s.Maximum != nil && value > *s.Maximum {
+		v.fail(pointer, "must be <= %v", *s.Maximum)
+	}
+	if s.ExclusiveMinimum != nil && value <= *s.ExclusiveMinimum {
+		v.fail(pointer, "must be > %v", *s.ExclusiveMinimum)
+	}
+	if s.ExclusiveMaximum != nil && value >= *s.ExclusiveMaximum {
+		v.fail(pointer, "must be < %v", *s.ExclusiveMaximum)
+	}
+}
+
+func matchesType(types []string, value interface{}) bool {
+	actual := typeOf(value)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func joinTypes(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return mustMarshal(types)
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustMarshal(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(data)
+}
@@ -0,0 +1,115 @@
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestValidateKeywords(t *testing.T) {
+	tests := map[string]struct {
+		schema string
+		doc    string
+		want   []ValidationError
+	}{
+		"type":                {`{"type": "string"}`, `"a"`, nil},
+		"type mismatch":       {`{"type": "string"}`, `1`, []ValidationError{{"", "must be of type string, got integer"}}},
+		"type list":           {`{"type": ["string", "null"]}`, `true`, []ValidationError{{"", `must be of type ["string","null"], got boolean`}}},
+		"integer is a number": {`{"type": "number"}`, `3`, nil},
+		"number not integer":  {`{"type": "integer"}`, `3.5`, []ValidationError{{"", "must be of type integer, got number"}}},
+		"enum":                {`{"enum": ["a", 1]}`, `1`, nil},
+		"enum mismatch":       {`{"enum": ["a", 1]}`, `"b"`, []ValidationError{{"", `must be one of ["a",1]`}}},
+		"const":               {`{"const": {"a": 1}}`, `{"a": 1}`, nil},
+		"const mismatch":      {`{"const": "plan"}`, `"x"`, []ValidationError{{"", `must be "plan"`}}},
+		"required": {
+			`{"required": ["a", "b/c"]}`, `{"a": 1}`,
+			[]ValidationError{{"/b~1c", "is required"}},
+		},
+		"properties": {
+			`{"properties": {"a": {"type": "string"}, "b": {"minimum": 0}}}`, `{"a": 1, "b": -1, "c": 1}`,
+			[]ValidationError{{"/a", "must be of type string, got integer"}, {"/b", "must be >= 0"}},
+		},
+		"additionalProperties false": {
+			`{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "~x": 2}`,
+			[]ValidationError{{"/~0x", "is not a known property"}},
+		},
+		"additionalProperties schema": {
+			`{"additionalProperties": {"type": "integer"}}`, `{"a": 1, "b": "2"}`,
+			[]ValidationError{{"/b", "must be of type integer, got string"}},
+		},
+		"items": {
+			`{"items": {"type": "integer"}}`, `[1, "2", 3]`,
+			[]ValidationError{{"/1", "must be of type integer, got string"}},
+		},
+		"minItems":    {`{"minItems": 2}`, `[1]`, []ValidationError{{"", "must have at least 2 items"}}},
+		"maxItems":    {`{"maxItems": 1}`, `[1, 2]`, []ValidationError{{"", "must have at most 1 items"}}},
+		"uniqueItems": {`{"uniqueItems": true}`, `[1, 2, 1]`, []ValidationError{{"/2", "duplicates item 0"}}},
+		"minimum":     {`{"minimum": 1}`, `0`, []ValidationError{{"", "must be >= 1"}}},
+		"maximum":     {`{"maximum": 1}`, `2`, []ValidationError{{"", "must be <= 1"}}},
+		"exclusiveMinimum": {
+			`{"exclusiveMinimum": 1}`, `1`, []ValidationError{{"", "must be > 1"}},
+		},
+		"exclusiveMaximum": {
+			`{"exclusiveMaximum": 1}`, `1`, []ValidationError{{"", "must be < 1"}},
+		},
+		"minLength counts runes":  {`{"minLength": 2}`, `"é"`, []ValidationError{{"", "must be at least 2 characters long"}}},
+		"maxLength":               {`{"maxLength": 1}`, `"ab"`, []ValidationError{{"", "must be at most 1 characters long"}}},
+		"pattern":                 {`{"pattern": "^[0-9]+$"}`, `"12a"`, []ValidationError{{"", "must match pattern ^[0-9]+$"}}},
+		"pattern ignores numbers": {`{"pattern": "^a$"}`, `1`, nil},
+		"format date":             {`{"format": "date"}`, `"2017-13-01"`, []ValidationError{{"", "must be a valid date"}}},
+		"format date-time":        {`{"format": "date-time"}`, `"2017-12-01T10:00:00Z"`, nil},
+		"unknown format":          {`{"format": "email"}`, `"not an email"`, nil},
+		"$ref to $defs": {
+			`{"properties": {"a": {"$ref": "#/$defs/id"}}, "$defs": {"id": {"minLength": 1}}}`, `{"a": ""}`,
+			[]ValidationError{{"/a", "must be at least 1 characters long"}},
+		},
+		"$ref to definitions": {
+			`{"items": {"$ref": "#/definitions/a~1b"}, "definitions": {"a/b": {"type": "string"}}}`, `["x", 1]`,
+			[]ValidationError{{"/1", "must be of type string, got integer"}},
+		},
+		"$ref to root": {
+			`{"properties": {"child": {"$ref": "#"}}, "required": ["id"]}`, `{"id": 1, "child": {"id": 2, "child": {}}}`,
+			[]ValidationError{{"/child/child/id", "is required"}},
+		},
+		"allOf": {
+			`{"allOf": [{"minimum": 1}, {"maximum": 2}]}`, `3`,
+			[]ValidationError{{"", "must be <= 2"}},
+		},
+		"anyOf":           {`{"anyOf": [{"type": "string"}, {"minimum": 5}]}`, `1`, []ValidationError{{"", "must match at least one schema of anyOf"}}},
+		"anyOf matched":   {`{"anyOf": [{"type": "string"}, {"minimum": 5}]}`, `6`, nil},
+		"oneOf":           {`{"oneOf": [{"minimum": 1}, {"maximum": 5}]}`, `3`, []ValidationError{{"", "must match exactly one schema of oneOf, matched 2"}}},
+		"oneOf matched":   {`{"oneOf": [{"minimum": 1}, {"maximum": 5}]}`, `6`, nil},
+		"not":             {`{"not": {"type": "null"}}`, `null`, []ValidationError{{"", "must not match the schema of not"}}},
+		"true schema":     {`true`, `{"a": 1}`, nil},
+		"false schema":    {`{"properties": {"a": false}}`, `{"a": 1}`, []ValidationError{{"/a", "is not allowed"}}},
+		"unknown keyword": {`{"title": "plan", "examples": [1]}`, `"a"`, nil},
+	}
+
+	for name, tt := range tests {
+		s, err := Compile([]byte(tt.schema))
+		if err != nil {
+			t.Errorf("%s: Compile() error = %v", name, err)
+			continue
+		}
+		var doc interface{}
+		if err := json.Unmarshal([]byte(tt.doc), &doc); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		got := s.Validate(doc, "")
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Validate() = %v, want %v", name, got, tt.want)
+		}
+	}
+}
+
+func TestValidatePrefixesPointers(t *testing.T) {
+	s, err := Compile([]byte(`{"properties": {"copay": {"minimum": 0}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.Validate(map[string]interface{}{"copay": float64(-1)}, "/planCostShares")
+	want := []ValidationError{{Pointer: "/planCostShares/copay", Message: "must be >= 0"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Validate() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,455 @@
+package search
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	defaultGroups = 10
+	maxPercents   = 10
+)
+
+// Metrics computed by an analytics request
+const (
+	MetricCount       = "count"
+	MetricAvg         = "avg"
+	MetricMin         = "min"
+	MetricMax         = "max"
+	MetricSum         = "sum"
+	MetricPercentiles = "percentiles"
+)
+
+var (
+	defaultMetrics  = []string{MetricCount, MetricAvg, MetricMin, MetricMax}
+	defaultPercents = []float64{50, 90, 99}
+)
+
+// AnalyticsRequest aggregates numeric fields of the documents of one relation,
+// for example the copay of every planserviceCostShares, optionally grouped by a
+// field of the same or of a related document
+type AnalyticsRequest struct {
+	// Of is the relation of the measured documents
+	Of string `json:"of"`
+	// Fields are the numeric fields that are measured
+	Fields []string `json:"fields"`
+	// Metrics default to count, avg, min and max
+	Metrics []string `json:"metrics,omitempty"`
+	// Percents are the percentiles computed with the percentiles metric
+	Percents []float64 `json:"percents,omitempty"`
+	GroupBy  *GroupBy  `json:"groupBy,omitempty"`
+	// Filter selects the measured documents
+	Filter Clauses `json:"filter"`
+}
+
+// GroupBy groups the measured documents by a field. Type is the relation holding
+// the field, by default the measured documents themselves; a field of a related
+// document groups the measured documents related to it, such as the cost shares
+// of the plans of every planType.
+type GroupBy struct {
+	Field string `json:"field"`
+	Type  string `json:"type,omitempty"`
+	// Size is the number of groups returned, the largest first
+	Size int `json:"size,omitempty"`
+}
+
+// Table is the flattened result of an analytics request, one row per group
+type Table struct {
+	Columns []string                 `json:"columns"`
+	Rows    []map[string]interface{} `json:"rows"`
+}
+
+// Build validates the request and translates it into the body of a search that
+// only returns aggregations
+func (req AnalyticsRequest) Build(fields Fields, join Join) (map[string]interface{}, error) {
+	if join.Field == "" {
+		return nil, invalid("the index has no join field")
+	}
+	if !join.known(req.Of) {
+		return nil, invalid("unknown relation %q in of", req.Of)
+	}
+	if len(req.Fields) == 0 {
+		return nil, invalid("fields needs at least one numeric field")
+	}
+	seen := map[string]bool{}
+	for _, field := range req.Fields {
+		fieldType, err := fields.lookup(field)
+		if err != nil {
+			return nil, err
+		}
+		if !numeric(fieldType) {
+			return nil, invalid("%s is a %s field and cannot be measured", field, fieldType)
+		}
+		if seen[field] {
+			return nil, invalid("%s is measured twice", field)
+		}
+		seen[field] = true
+	}
+	for _, metric := range req.metrics() {
+		switch metric {
+		case MetricCount, MetricAvg, MetricMin, MetricMax, MetricSum, MetricPercentiles:
+		default:
+			return nil, invalid("unknown metric %q, metrics are count, avg, min, max, sum and percentiles", metric)
+		}
+	}
+	if len(req.Percents) > maxPercents {
+		return nil, invalid("at most %d percents can be computed", maxPercents)
+	}
+	for _, percent := range req.Percents {
+		if percent < 0 || percent > 100 {
+			return nil, invalid("percents must be between 0 and 100")
+		}
+	}
+
+	filter, err := req.Filter.Query(fields)
+	if err != nil {
+		return nil, fmt.Errorf("%w (filter)", err)
+	}
+	metrics := map[string]interface{}{}
+	for _, field := range req.Fields {
+		metrics[field+".stats"] = map[string]interface{}{"stats": map[string]interface{}{"field": field}}
+		if req.wants(MetricPercentiles) {
+			metrics[field+".percentiles"] = map[string]interface{}{
+				"percentiles": map[string]interface{}{"field": field, "percents": req.percents(), "keyed": false},
+			}
+		}
+	}
+	measured := map[string]interface{}{"filter": filter, "aggs": metrics}
+
+	if req.GroupBy == nil {
+		return map[string]interface{}{
+			"size":  0,
+			"query": map[string]interface{}{"term": map[string]interface{}{join.Field: req.Of}},
+			"aggs":  map[string]interface{}{"measured": measured},
+		}, nil
+	}
+
+	group, owner, err := req.GroupBy.terms(fields, join, req.Of)
+	if err != nil {
+		return nil, err
+	}
+	steps, err := join.between(owner, req.Of)
+	if err != nil {
+		return nil, err
+	}
+
+	// Walk from the grouped documents to the measured ones, innermost first. Every
+	// step is named related, so the response is read back the same way.
+	aggs := map[string]interface{}{"measured": measured}
+	for i := len(steps) - 1; i >= 0; i-- {
+		aggs = map[string]interface{}{"related": steps[i].aggregation(aggs)}
+	}
+	group["aggs"] = aggs
+
+	return map[string]interface{}{
+		"size":  0,
+		"query": map[string]interface{}{"term": map[string]interface{}{join.Field: owner}},
+		"aggs":  map[string]interface{}{"group": group},
+	}, nil
+}
+
+// terms builds the terms aggregation of the grouping and returns it with the
+// relation holding the field. Text fields are grouped by their keyword multi-field.
+func (g GroupBy) terms(fields Fields, join Join, of string) (map[string]interface{}, string, error) {
+	owner := g.Type
+	if owner == "" {
+		owner = of
+	}
+	if !join.known(owner) {
+		return nil, "", invalid("unknown relation %q in groupBy", owner)
+	}
+
+	field := g.Field
+	fieldType, err := fields.lookup(field)
+	if err != nil {
+		return nil, "", err
+	}
+	if fullText(fieldType) {
+		if fields[field+".keyword"] != "keyword" {
+			return nil, "", invalid("%s is a %s field and cannot be grouped by", field, fieldType)
+		}
+		field += ".keyword"
+	}
+
+	size := g.Size
+	if size == 0 {
+		size = defaultGroups
+	}
+	if size < 0 || size > MaxSize {
+		return nil, "", invalid("groupBy size must be between 1 and %d", MaxSize)
+	}
+	return map[string]interface{}{
+		"terms": map[string]interface{}{"field": field, "size": size},
+	}, owner, nil
+}
+
+// step moves an aggregation from documents of one relation to their parents or
+// children of another
+type step struct {
+	parent bool
+	// relation is the child relation of the step, the one that is left for a
+	// parent aggregation and the one that is entered for a children aggregation
+	relation string
+}
+
+func (s step) aggregation(aggs map[string]interface{}) map[string]interface{} {
+	aggregation := map[string]interface{}{"children": map[string]interface{}{"type": s.relation}}
+	if s.parent {
+		aggregation = map[string]interface{}{"parent": map[string]interface{}{"type": s.relation}}
+	}
+	if len(aggs) > 0 {
+		aggregation["aggs"] = aggs
+	}
+	return aggregation
+}
+
+// between returns the steps from the documents of one relation to the related
+// documents of another: up to their closest common ancestor, then down
+func (j Join) between(from, to string) ([]step, error) {
+	up, down := j.ancestors(from), j.ancestors(to)
+	for i, relation := range up {
+		for k, target := range down {
+			if relation != target {
+				continue
+			}
+			steps := make([]step, 0, i+k)
+			for _, child := range up[:i] {
+				steps = append(steps, step{parent: true, relation: child})
+			}
+			for n := k - 1; n >= 0; n-- {
+				steps = append(steps, step{relation: down[n]})
+			}
+			return steps, nil
+		}
+	}
+	return nil, invalid("%s and %s are not related", from, to)
+}
+
+// ancestors lists a relation followed by its parent, grandparent and so on
+func (j Join) ancestors(relation string) []string {
+	ancestors := []string{relation}
+	for {
+		parent, ok := j.parents[relation]
+		if !ok {
+			return ancestors
+		}
+		ancestors = append(ancestors, parent)
+		relation = parent
+	}
+}
+
+func (req AnalyticsRequest) metrics() []string {
+	if len(req.Metrics) == 0 {
+		return defaultMetrics
+	}
+	return req.Metrics
+}
+
+func (req AnalyticsRequest) wants(metric string) bool {
+	for _, m := range req.metrics() {
+		if m == metric {
+			return true
+		}
+	}
+	return false
+}
+
+func (req AnalyticsRequest) percents() []float64 {
+	if len(req.Percents) == 0 {
+		return defaultPercents
+	}
+	return req.Percents
+}
+
+// Columns are the columns of the table of the request: the group, the number of
+// measured documents, then every metric of every field as field.metric
+func (req AnalyticsRequest) Columns() []string {
+	columns := make([]string, 0)
+	if req.GroupBy != nil {
+		columns = append(columns, req.GroupBy.Field)
+	}
+	columns = append(columns, "documents")
+	for _, field := range req.Fields {
+		for _, metric := range req.metrics() {
+			if metric != MetricPercentiles {
+				columns = append(columns, field+"."+metric)
+				continue
+			}
+			for _, percent := range req.percents() {
+				columns = append(columns, field+"."+percentColumn(percent))
+			}
+		}
+	}
+	return columns
+}
+
+func percentColumn(percent float64) string {
+	return "p" + strconv.FormatFloat(percent, 'f', -1, 64)
+}
+
+type statsAggregation struct {
+	Count int64    `json:"count"`
+	Min   *float64 `json:"min"`
+	Max   *float64 `json:"max"`
+	Avg   *float64 `json:"avg"`
+	Sum   float64  `json:"sum"`
+}
+
+type percentilesAggregation struct {
+	Values []struct {
+		Key   float64  `json:"key"`
+		Value *float64 `json:"value"`
+	} `json:"values"`
+}
+
+// Table flattens the aggregations of the response to a request built by Build
+func (req AnalyticsRequest) Table(aggregations json.RawMessage) (Table, error) {
+	table := Table{Columns: req.Columns(), Rows: make([]map[string]interface{}, 0)}
+
+	var root map[string]json.RawMessage
+	err := json.Unmarshal(aggregations, &root)
+	if err != nil {
+		return table, err
+	}
+
+	if req.GroupBy == nil {
+		row, err := req.row(root["measured"])
+		if err != nil {
+			return table, err
+		}
+		table.Rows = append(table.Rows, row)
+		return table, nil
+	}
+
+	var group struct {
+		Buckets []map[string]json.RawMessage `json:"buckets"`
+	}
+	err = json.Unmarshal(root["group"], &group)
+	if err != nil {
+		return table, err
+	}
+	for _, bucket := range group.Buckets {
+		var key interface{}
+		err := json.Unmarshal(bucket["key"], &key)
+		if err != nil {
+			return table, err
+		}
+		// Follow the parent and children aggregations down to the measured documents
+		measured, err := findMeasured(bucket)
+		if err != nil {
+			return table, err
+		}
+		row, err := req.row(measured)
+		if err != nil {
+			return table, err
+		}
+		row[req.GroupBy.Field] = key
+		table.Rows = append(table.Rows, row)
+	}
+	return table, nil
+}
+
+func findMeasured(aggregation map[string]json.RawMessage) (json.RawMessage, error) {
+	for {
+		if measured, ok := aggregation["measured"]; ok {
+			return measured, nil
+		}
+		next, ok := aggregation["related"]
+		if !ok {
+			return nil, fmt.Errorf("the response has no measured aggregation")
+		}
+		aggregation = nil
+		err := json.Unmarshal(next, &aggregation)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// row reads the metrics of one measured aggregation into a row
+func (req AnalyticsRequest) row(raw json.RawMessage) (map[string]interface{}, error) {
+	var measured map[string]json.RawMessage
+	err := json.Unmarshal(raw, &measured)
+	if err != nil {
+		return nil, err
+	}
+	var documents int64
+	err = json.Unmarshal(measured["doc_count"], &documents)
+	if err != nil {
+		return nil, err
+	}
+
+	row := map[string]interface{}{"documents": documents}
+	for _, field := range req.Fields {
+		var stats statsAggregation
+		err := json.Unmarshal(measured[field+".stats"], &stats)
+		if err != nil {
+			return nil, err
+		}
+		for _, metric := range req.metrics() {
+			switch metric {
+			case MetricCount:
+				row[field+".count"] = stats.Count
+			case MetricAvg:
+				row[field+".avg"] = stats.Avg
+			case MetricMin:
+				row[field+".min"] = stats.Min
+			case MetricMax:
+				row[field+".max"] = stats.Max
+			case MetricSum:
+				row[field+".sum"] = stats.Sum
+			case MetricPercentiles:
+				var percentiles percentilesAggregation
+				err := json.Unmarshal(measured[field+".percentiles"], &percentiles)
+				if err != nil {
+					return nil, err
+				}
+				for _, value := range percentiles.Values {
+					row[field+"."+percentColumn(value.Key)] = value.Value
+				}
+			}
+		}
+	}
+	return row, nil
+}
+
+// WriteCSV writes the table as CSV with a header row. Metrics without a value,
+// such as the average of a group without documents, are left empty.
+func (t Table) WriteCSV(w io.Writer) error {
+	writer := csv.NewWriter(w)
+	err := writer.Write(t.Columns)
+	if err != nil {
+		return err
+	}
+	record := make([]string, len(t.Columns))
+	for _, row := range t.Rows {
+		for i, column := range t.Columns {
+			record[i] = csvValue(row[column])
+		}
+		err := writer.Write(record)
+		if err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func csvValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case *float64:
+		if value == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*value, 'f', -1, 64)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,118 @@
+package search
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/girish332/bigdata/elastic"
+	"strings"
+	"testing"
+)
+
+func TestAnalyticsWalksToTheMeasuredDocuments(t *testing.T) {
+	mapping := elastic.Mapping()
+	fields, join := NewFields(mapping), NewJoin(mapping)
+
+	tests := map[string]struct {
+		groupBy GroupBy
+		query   string
+		aggs    string
+	}{
+		"parent field": {
+			groupBy: GroupBy{Field: "planType", Type: "plan"},
+			query:   `{"term":{"plan_join":"plan"}}`,
+			aggs: `{"group":{"aggs":{"related":{"aggs":{"related":{"aggs":{"measured":` +
+				`{"aggs":{"copay.stats":{"stats":{"field":"copay"}}},"filter":{"match_all":{}}}},` +
+				`"children":{"type":"planserviceCostShares"}}},"children":{"type":"linkedPlanServices"}}},` +
+				`"terms":{"field":"planType","size":10}}}`,
+		},
+		"sibling text field": {
+			groupBy: GroupBy{Field: "name", Type: "linkedService", Size: 5},
+			query:   `{"term":{"plan_join":"linkedService"}}`,
+			aggs: `{"group":{"aggs":{"related":{"aggs":{"related":{"aggs":{"measured":` +
+				`{"aggs":{"copay.stats":{"stats":{"field":"copay"}}},"filter":{"match_all":{}}}},` +
+				`"children":{"type":"planserviceCostShares"}}},"parent":{"type":"linkedService"}}},` +
+				`"terms":{"field":"name.keyword","size":5}}}`,
+		},
+		"own field": {
+			groupBy: GroupBy{Field: "_org"},
+			query:   `{"term":{"plan_join":"planserviceCostShares"}}`,
+			aggs: `{"group":{"aggs":{"measured":` +
+				`{"aggs":{"copay.stats":{"stats":{"field":"copay"}}},"filter":{"match_all":{}}}},` +
+				`"terms":{"field":"_org","size":10}}}`,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			groupBy := test.groupBy
+			req := AnalyticsRequest{Of: "planserviceCostShares", Fields: []string{"copay"}, GroupBy: &groupBy}
+			body, err := req.Build(fields, join)
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			query, _ := json.Marshal(body["query"])
+			aggs, _ := json.Marshal(body["aggs"])
+			if string(query) != test.query {
+				t.Errorf("Build() query = %s, want %s", query, test.query)
+			}
+			if string(aggs) != test.aggs {
+				t.Errorf("Build() aggs = %s, want %s", aggs, test.aggs)
+			}
+		})
+	}
+
+	invalid := map[string]AnalyticsRequest{
+		"text field":     {Of: "planserviceCostShares", Fields: []string{"name"}},
+		"no fields":      {Of: "planserviceCostShares"},
+		"unknown metric": {Of: "planserviceCostShares", Fields: []string{"copay"}, Metrics: []string{"median"}},
+		"bad percent":    {Of: "planserviceCostShares", Fields: []string{"copay"}, Percents: []float64{120}},
+		"unknown of":     {Of: "membercostshare", Fields: []string{"copay"}},
+	}
+	for name, req := range invalid {
+		if _, err := req.Build(fields, join); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: Build() error = %v, want ErrInvalidQuery", name, err)
+		}
+	}
+}
+
+func TestAnalyticsTable(t *testing.T) {
+	req := AnalyticsRequest{
+		Of:       "planserviceCostShares",
+		Fields:   []string{"copay"},
+		Metrics:  []string{MetricAvg, MetricMax, MetricPercentiles},
+		Percents: []float64{50, 99.5},
+		GroupBy:  &GroupBy{Field: "planType", Type: "plan"},
+	}
+	aggregations := `{"group": {"buckets": [
+		{"key": "inNetwork", "doc_count": 2, "related": {"doc_count": 3, "related": {"doc_count": 3, "measured": {
+			"doc_count": 3,
+			"copay.stats": {"count": 3, "min": 0, "max": 175, "avg": 75, "sum": 225},
+			"copay.percentiles": {"values": [{"key": 50.0, "value": 50}, {"key": 99.5, "value": 175}]}
+		}}}},
+		{"key": "outOfNetwork", "doc_count": 1, "related": {"doc_count": 0, "related": {"doc_count": 0, "measured": {
+			"doc_count": 0,
+			"copay.stats": {"count": 0, "min": null, "max": null, "avg": null, "sum": 0},
+			"copay.percentiles": {"values": [{"key": 50.0, "value": null}, {"key": 99.5, "value": null}]}
+		}}}}
+	]}}`
+
+	table, err := req.Table(json.RawMessage(aggregations))
+	if err != nil {
+		t.Fatalf("Table() error = %v", err)
+	}
+	var out bytes.Buffer
+	err = table.WriteCSV(&out)
+	if err != nil {
+		t.Fatalf("WriteCSV() error = %v", err)
+	}
+
+	want := strings.Join([]string{
+		"planType,documents,copay.avg,copay.max,copay.p50,copay.p99.5",
+		"inNetwork,3,75,175,50,175",
+		"outOfNetwork,0,,,,",
+		"",
+	}, "\n")
+	if out.String() != want {
+		t.Errorf("WriteCSV() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
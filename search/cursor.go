@@ -0,0 +1,89 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+)
+
+const (
+	// PaginateCursor walks the hits with a point in time and search_after
+	// instead of from and size
+	PaginateCursor = "cursor"
+	// KeepAlive is how long a point in time is kept open between two pages
+	KeepAlive = "1m"
+)
+
+// Cursor is the state of a search walked page by page. It holds the validated
+// request rather than the translated query, so every page is checked again.
+type Cursor struct {
+	Request Request `json:"request"`
+	// PIT is the id of the point in time the pages are read from
+	PIT string `json:"pit"`
+	// After are the sort values of the last hit of the previous page, kept raw so
+	// large numbers survive the round trip
+	After []json.RawMessage `json:"after,omitempty"`
+}
+
+// Encode turns the cursor into the opaque next token of a page
+func (c Cursor) Encode() (string, error) {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// DecodeCursor reads a next token back into its cursor
+func DecodeCursor(token string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return Cursor{}, invalid("invalid cursor")
+	}
+	var cursor Cursor
+	err = json.Unmarshal(raw, &cursor)
+	if err != nil || cursor.PIT == "" || cursor.Request.Paginate != PaginateCursor {
+		return Cursor{}, invalid("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// Page translates the cursor into the search for its next page. Hits are sorted
+// by the sort of the request, or by score, with _shard_doc as the tiebreaker that
+// makes the order total within the point in time.
+func (c Cursor) Page(fields Fields) (map[string]interface{}, error) {
+	req := c.Request
+	if req.From != 0 {
+		return nil, invalid("from cannot be used with cursor pagination")
+	}
+	size, err := req.size()
+	if err != nil {
+		return nil, err
+	}
+	query, err := req.Query(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	sorts := []interface{}{map[string]interface{}{"_score": map[string]interface{}{"order": "desc"}}}
+	if len(req.Sort) > 0 {
+		sorts, err = buildSort(req.Sort, fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sorts = append(sorts, map[string]interface{}{"_shard_doc": map[string]interface{}{"order": "asc"}})
+
+	body := map[string]interface{}{
+		"query": query,
+		"size":  size,
+		"sort":  sorts,
+		"pit":   map[string]interface{}{"id": c.PIT, "keep_alive": KeepAlive},
+	}
+	if len(c.After) > 0 {
+		if len(c.After) != len(sorts) {
+			return nil, invalid("invalid cursor")
+		}
+		body["search_after"] = c.After
+	}
+	return body, nil
+}
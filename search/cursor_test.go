@@ -0,0 +1,79 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestCursorPagesAfterTheLastHit(t *testing.T) {
+	req := Request{Sort: []Sort{{Field: "copay", Order: "desc"}}, Size: 2, Paginate: PaginateCursor}
+	req.ObjectType = "membercostshare"
+
+	first, err := Cursor{Request: req, PIT: "pit-1"}.Page(testFields)
+	if err != nil {
+		t.Fatalf("Page() error = %v", err)
+	}
+	if _, ok := first["search_after"]; ok {
+		t.Error("the first page should not search after anything")
+	}
+	if _, ok := first["from"]; ok {
+		t.Error("cursor pages should not use from")
+	}
+	sorts, _ := json.Marshal(first["sort"])
+	if string(sorts) != `[{"copay":{"order":"desc"}},{"_shard_doc":{"order":"asc"}}]` {
+		t.Errorf("Page() sort = %s, want copay then _shard_doc", sorts)
+	}
+
+	// Sort values beyond float64 precision have to survive the token
+	token, err := Cursor{Request: req, PIT: "pit-2", After: []json.RawMessage{json.RawMessage(`175`), json.RawMessage(`9007199254740993`)}}.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	cursor, err := DecodeCursor(token)
+	if err != nil {
+		t.Fatalf("DecodeCursor() error = %v", err)
+	}
+	next, err := cursor.Page(testFields)
+	if err != nil {
+		t.Fatalf("Page() error = %v", err)
+	}
+	after, _ := json.Marshal(next["search_after"])
+	pit, _ := json.Marshal(next["pit"])
+	if string(after) != `[175,9007199254740993]` || string(pit) != `{"id":"pit-2","keep_alive":"1m"}` {
+		t.Errorf("Page() search_after = %s pit = %s", after, pit)
+	}
+}
+
+func TestInvalidCursorsAreRejected(t *testing.T) {
+	valid := Request{Paginate: PaginateCursor}
+	tokens := map[string]string{
+		"not base64":     "%%%",
+		"not json":       "bm90IGpzb24",
+		"without pit":    mustEncode(t, Cursor{Request: valid}),
+		"not paginating": mustEncode(t, Cursor{Request: Request{}, PIT: "pit"}),
+	}
+	for name, token := range tokens {
+		if _, err := DecodeCursor(token); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: DecodeCursor() error = %v, want ErrInvalidQuery", name, err)
+		}
+	}
+
+	// A forged cursor is validated like any other request
+	forged := Cursor{Request: Request{Sort: []Sort{{Field: "secret"}}, Paginate: PaginateCursor}, PIT: "pit"}
+	if _, err := forged.Page(testFields); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Page() of a forged cursor error = %v, want ErrInvalidQuery", err)
+	}
+	withFrom := Cursor{Request: Request{From: 10, Paginate: PaginateCursor}, PIT: "pit"}
+	if _, err := withFrom.Page(testFields); !errors.Is(err, ErrInvalidQuery) {
+		t.Errorf("Page() with from error = %v, want ErrInvalidQuery", err)
+	}
+}
+
+func mustEncode(t *testing.T, cursor Cursor) string {
+	token, err := cursor.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
@@ -0,0 +1,375 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultSize = 20
+	MaxSize     = 100
+	// maxWindow is the deepest page Elasticsearch serves with from and size
+	maxWindow = 10000
+)
+
+var ErrInvalidQuery = errors.New("invalid search request")
+
+// Clauses select documents in a bool query; must and should clauses score
+// hits, filter and mustNot clauses only include or exclude them
+type Clauses struct {
+	// ObjectType restricts the hits to documents of one objectType
+	ObjectType string   `json:"objectType,omitempty"`
+	Must       []Clause `json:"must,omitempty"`
+	Should     []Clause `json:"should,omitempty"`
+	MustNot    []Clause `json:"mustNot,omitempty"`
+	Filter     []Clause `json:"filter,omitempty"`
+	// MinimumShouldMatch is the number of should clauses a hit has to match,
+	// by default 1 when there are no must or filter clauses and 0 otherwise
+	MinimumShouldMatch int `json:"minimumShouldMatch,omitempty"`
+}
+
+// Request is a structured search over the plan documents
+type Request struct {
+	Clauses
+	Sort []Sort `json:"sort,omitempty"`
+	From int    `json:"from,omitempty"`
+	Size int    `json:"size,omitempty"`
+	// Paginate is cursor to walk the hits with a point in time and search_after,
+	// by default pages are read with from and size
+	Paginate string `json:"paginate,omitempty"`
+}
+
+// Clause is exactly one of a term, range or match condition
+type Clause struct {
+	Term  *Term  `json:"term,omitempty"`
+	Range *Range `json:"range,omitempty"`
+	Match *Match `json:"match,omitempty"`
+}
+
+// Term matches documents whose field is exactly the value
+type Term struct {
+	Field string      `json:"field"`
+	Value interface{} `json:"value"`
+}
+
+// Range matches documents whose field lies within the given bounds
+type Range struct {
+	Field string      `json:"field"`
+	Gt    interface{} `json:"gt,omitempty"`
+	Gte   interface{} `json:"gte,omitempty"`
+	Lt    interface{} `json:"lt,omitempty"`
+	Lte   interface{} `json:"lte,omitempty"`
+}
+
+// Match runs a full text query against the field
+type Match struct {
+	Field string `json:"field"`
+	Query string `json:"query"`
+}
+
+// Sort orders the hits by a field, asc or desc
+type Sort struct {
+	Field string `json:"field"`
+	Order string `json:"order,omitempty"`
+}
+
+// Fields are the searchable fields of the index and their mapping types
+type Fields map[string]string
+
+// NewFields collects the searchable fields from the properties of a mapping,
+// along with their multi-fields such as name.keyword. Join fields are left out,
+// they are queried through has_child and has_parent.
+func NewFields(mapping map[string]interface{}) Fields {
+	fields := Fields{}
+	properties, _ := mapping["properties"].(map[string]interface{})
+	for name, property := range properties {
+		definition, _ := property.(map[string]interface{})
+		fieldType, _ := definition["type"].(string)
+		if fieldType == "" || fieldType == "join" {
+			continue
+		}
+		fields[name] = fieldType
+
+		subfields, _ := definition["fields"].(map[string]interface{})
+		for subname, subfield := range subfields {
+			subdefinition, _ := subfield.(map[string]interface{})
+			if subtype, ok := subdefinition["type"].(string); ok {
+				fields[name+"."+subname] = subtype
+			}
+		}
+	}
+	return fields
+}
+
+func (f Fields) names() string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Decode reads a request into out, rejecting unknown properties so typos do not
+// silently widen a search
+func Decode(r io.Reader, out interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	dec.UseNumber()
+	if err := dec.Decode(out); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%w: unexpected data after the request", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Build validates the request against the searchable fields and translates it
+// into the body of an Elasticsearch search request
+func (req Request) Build(fields Fields) (map[string]interface{}, error) {
+	query, err := req.Query(fields)
+	if err != nil {
+		return nil, err
+	}
+	return req.body(query, fields)
+}
+
+// body adds the sorting and paging of the request to a query
+func (req Request) body(query map[string]interface{}, fields Fields) (map[string]interface{}, error) {
+	if req.Paginate != "" && req.Paginate != PaginateCursor {
+		return nil, invalid("paginate must be %s", PaginateCursor)
+	}
+	size, err := req.size()
+	if err != nil {
+		return nil, err
+	}
+	if req.From < 0 || req.From+size > maxWindow {
+		return nil, invalid("from must be at least 0 and from + size at most %d", maxWindow)
+	}
+
+	body := map[string]interface{}{
+		"query": query,
+		"from":  req.From,
+		"size":  size,
+	}
+	if len(req.Sort) > 0 {
+		sorts, err := buildSort(req.Sort, fields)
+		if err != nil {
+			return nil, err
+		}
+		body["sort"] = sorts
+	}
+	return body, nil
+}
+
+// Query validates the clauses and translates them into a bool query, or
+// match_all when there are none
+func (req Clauses) Query(fields Fields) (map[string]interface{}, error) {
+	boolQuery := map[string]interface{}{}
+	groups := []struct {
+		name    string
+		clauses []Clause
+	}{
+		{"must", req.Must},
+		{"should", req.Should},
+		{"must_not", req.MustNot},
+		{"filter", req.Filter},
+	}
+	for _, group := range groups {
+		if len(group.clauses) == 0 {
+			continue
+		}
+		queries := make([]interface{}, 0, len(group.clauses))
+		for i, clause := range group.clauses {
+			query, err := clause.build(fields)
+			if err != nil {
+				return nil, fmt.Errorf("%w (%s[%d])", err, group.name, i)
+			}
+			queries = append(queries, query)
+		}
+		boolQuery[group.name] = queries
+	}
+
+	if req.ObjectType != "" {
+		filter, _ := boolQuery["filter"].([]interface{})
+		boolQuery["filter"] = append(filter, map[string]interface{}{
+			"term": map[string]interface{}{"objectType": req.ObjectType},
+		})
+	}
+
+	if req.MinimumShouldMatch < 0 || req.MinimumShouldMatch > len(req.Should) {
+		return nil, invalid("minimumShouldMatch must be between 0 and the number of should clauses")
+	}
+	if req.MinimumShouldMatch > 0 {
+		boolQuery["minimum_should_match"] = req.MinimumShouldMatch
+	}
+
+	if len(boolQuery) == 0 {
+		return map[string]interface{}{"match_all": map[string]interface{}{}}, nil
+	}
+	return map[string]interface{}{"bool": boolQuery}, nil
+}
+
+func (c Clause) build(fields Fields) (map[string]interface{}, error) {
+	set := 0
+	for _, present := range []bool{c.Term != nil, c.Range != nil, c.Match != nil} {
+		if present {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, invalid("a clause needs exactly one of term, range or match")
+	}
+
+	switch {
+	case c.Term != nil:
+		fieldType, err := fields.lookup(c.Term.Field)
+		if err != nil {
+			return nil, err
+		}
+		if fullText(fieldType) {
+			return nil, invalid("%s is a %s field, use match instead of term", c.Term.Field, fieldType)
+		}
+		if err := checkValue(c.Term.Field, fieldType, c.Term.Value); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"term": map[string]interface{}{c.Term.Field: c.Term.Value},
+		}, nil
+	case c.Range != nil:
+		fieldType, err := fields.lookup(c.Range.Field)
+		if err != nil {
+			return nil, err
+		}
+		if !rangeable(fieldType) {
+			return nil, invalid("%s is a %s field and does not support range", c.Range.Field, fieldType)
+		}
+		bounds := map[string]interface{}{}
+		for op, value := range map[string]interface{}{"gt": c.Range.Gt, "gte": c.Range.Gte, "lt": c.Range.Lt, "lte": c.Range.Lte} {
+			if value == nil {
+				continue
+			}
+			if err := checkValue(c.Range.Field, fieldType, value); err != nil {
+				return nil, err
+			}
+			bounds[op] = value
+		}
+		if len(bounds) == 0 {
+			return nil, invalid("range on %s needs at least one of gt, gte, lt or lte", c.Range.Field)
+		}
+		return map[string]interface{}{
+			"range": map[string]interface{}{c.Range.Field: bounds},
+		}, nil
+	default:
+		if _, err := fields.lookup(c.Match.Field); err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(c.Match.Query) == "" {
+			return nil, invalid("match on %s needs a query", c.Match.Field)
+		}
+		return map[string]interface{}{
+			"match": map[string]interface{}{c.Match.Field: c.Match.Query},
+		}, nil
+	}
+}
+
+func (req Request) size() (int, error) {
+	size := req.Size
+	if size == 0 {
+		size = DefaultSize
+	}
+	if size < 0 || size > MaxSize {
+		return 0, invalid("size must be between 1 and %d", MaxSize)
+	}
+	return size, nil
+}
+
+func buildSort(sorts []Sort, fields Fields) ([]interface{}, error) {
+	result := make([]interface{}, 0, len(sorts))
+	for _, s := range sorts {
+		if s.Field == "_score" {
+			result = append(result, map[string]interface{}{"_score": map[string]interface{}{"order": orderOrDefault(s.Order, "desc")}})
+			continue
+		}
+		fieldType, err := fields.lookup(s.Field)
+		if err != nil {
+			return nil, err
+		}
+		if fullText(fieldType) {
+			return nil, invalid("%s is a %s field and cannot be sorted on", s.Field, fieldType)
+		}
+		order := orderOrDefault(s.Order, "asc")
+		if order != "asc" && order != "desc" {
+			return nil, invalid("sort order of %s must be asc or desc", s.Field)
+		}
+		result = append(result, map[string]interface{}{s.Field: map[string]interface{}{"order": order}})
+	}
+	return result, nil
+}
+
+func orderOrDefault(order, fallback string) string {
+	if order == "" {
+		return fallback
+	}
+	return order
+}
+
+func (f Fields) lookup(field string) (string, error) {
+	fieldType, ok := f[field]
+	if !ok {
+		return "", invalid("unknown field %q, searchable fields are %s", field, f.names())
+	}
+	return fieldType, nil
+}
+
+// fullText reports whether a field is analyzed, so it can only be matched
+func fullText(fieldType string) bool {
+	return fieldType == "text" || fieldType == "search_as_you_type"
+}
+
+func rangeable(fieldType string) bool {
+	return numeric(fieldType) || fieldType == "date"
+}
+
+func numeric(fieldType string) bool {
+	switch fieldType {
+	case "long", "integer", "short", "byte", "double", "float":
+		return true
+	}
+	return false
+}
+
+// checkValue makes sure a term or range value fits the type of the field, so a
+// bad value is rejected here instead of failing inside Elasticsearch
+func checkValue(field, fieldType string, value interface{}) error {
+	switch fieldType {
+	case "long", "integer", "short", "byte", "double", "float":
+		number, ok := value.(json.Number)
+		if !ok {
+			return invalid("%s needs a number", field)
+		}
+		if fieldType != "double" && fieldType != "float" {
+			if _, err := number.Int64(); err != nil {
+				return invalid("%s needs a whole number", field)
+			}
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return invalid("%s needs true or false", field)
+		}
+	default:
+		if _, ok := value.(string); !ok {
+			return invalid("%s needs a string", field)
+		}
+	}
+	return nil
+}
+
+func invalid(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidQuery, fmt.Sprintf(format, args...))
+}
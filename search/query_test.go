@@ -0,0 +1,89 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testFields = Fields{
+	"objectType":   "keyword",
+	"_org":         "keyword",
+	"copay":        "long",
+	"name":         "text",
+	"creationDate": "date",
+}
+
+func TestBuildTranslatesClauses(t *testing.T) {
+	var req Request
+	err := Decode(strings.NewReader(`{
+		"objectType": "membercostshare",
+		"must": [{"match": {"field": "name", "query": "physical"}}],
+		"filter": [{"range": {"field": "copay", "gte": 10}}],
+		"mustNot": [{"term": {"field": "_org", "value": "example.com"}}],
+		"sort": [{"field": "copay", "order": "desc"}],
+		"size": 5
+	}`), &req)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	body, err := req.Build(testFields)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	got, _ := json.Marshal(body)
+	want := `{"from":0,"query":{"bool":{` +
+		`"filter":[{"range":{"copay":{"gte":10}}},{"term":{"objectType":"membercostshare"}}],` +
+		`"must":[{"match":{"name":"physical"}}],` +
+		`"must_not":[{"term":{"_org":"example.com"}}]}},` +
+		`"size":5,"sort":[{"copay":{"order":"desc"}}]}`
+	if string(got) != want {
+		t.Errorf("Build() = %s, want %s", got, want)
+	}
+}
+
+func TestBuildWithoutClausesMatchesAll(t *testing.T) {
+	body, err := Request{}.Build(testFields)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	want := map[string]interface{}{"match_all": map[string]interface{}{}}
+	if !reflect.DeepEqual(body["query"], want) || body["size"] != DefaultSize {
+		t.Errorf("Build() = %v, want match_all with size %d", body, DefaultSize)
+	}
+}
+
+func TestInvalidRequestsAreRejected(t *testing.T) {
+	tests := map[string]string{
+		"unknown property":    `{"query": {"match_all": {}}}`,
+		"unknown field":       `{"filter": [{"term": {"field": "secret", "value": "x"}}]}`,
+		"term on text":        `{"filter": [{"term": {"field": "name", "value": "x"}}]}`,
+		"range on keyword":    `{"filter": [{"range": {"field": "_org", "gte": "a"}}]}`,
+		"range without bound": `{"filter": [{"range": {"field": "copay"}}]}`,
+		"string for number":   `{"filter": [{"range": {"field": "copay", "gte": "10"}}]}`,
+		"fraction for long":   `{"filter": [{"term": {"field": "copay", "value": 1.5}}]}`,
+		"two conditions":      `{"must": [{"term": {"field": "_org", "value": "x"}, "match": {"field": "name", "query": "y"}}]}`,
+		"empty clause":        `{"must": [{}]}`,
+		"sort on text":        `{"sort": [{"field": "name"}]}`,
+		"bad sort order":      `{"sort": [{"field": "copay", "order": "up"}]}`,
+		"size too large":      `{"size": 1000}`,
+		"negative from":       `{"from": -1}`,
+		"too deep":            `{"from": 9990, "size": 20}`,
+		"minimum should":      `{"should": [{"match": {"field": "name", "query": "y"}}], "minimumShouldMatch": 2}`,
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			var req Request
+			err := Decode(strings.NewReader(body), &req)
+			if err == nil {
+				_, err = req.Build(testFields)
+			}
+			if !errors.Is(err, ErrInvalidQuery) {
+				t.Errorf("got error %v, want ErrInvalidQuery", err)
+			}
+		})
+	}
+}
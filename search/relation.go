@@ -0,0 +1,179 @@
+package search
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// maxInnerHits is the most related documents returned per hit and level, the
+// default max_inner_result_window of an index
+const maxInnerHits = 100
+
+// Join describes the join field of the index and the relations it defines
+type Join struct {
+	Field string
+	// parents maps every child relation to its parent relation
+	parents map[string]string
+	names   []string
+}
+
+// NewJoin reads the join field and its relations from the properties of a
+// mapping. The Join is empty when the mapping has no join field.
+func NewJoin(mapping map[string]interface{}) Join {
+	join := Join{parents: map[string]string{}}
+	properties, _ := mapping["properties"].(map[string]interface{})
+	for name, property := range properties {
+		definition, _ := property.(map[string]interface{})
+		if definition["type"] != "join" {
+			continue
+		}
+		join.Field = name
+
+		relations, _ := definition["relations"].(map[string]interface{})
+		known := map[string]bool{}
+		for parent, children := range relations {
+			known[parent] = true
+			for _, child := range relationNames(children) {
+				join.parents[child] = parent
+				known[child] = true
+			}
+		}
+		for relation := range known {
+			join.names = append(join.names, relation)
+		}
+		sort.Strings(join.names)
+	}
+	return join
+}
+
+// relationNames reads the children of a relation, a single name or a list of
+// names depending on whether the mapping was built in Go or decoded from JSON
+func relationNames(children interface{}) []string {
+	switch children := children.(type) {
+	case string:
+		return []string{children}
+	case []string:
+		return children
+	case []interface{}:
+		names := make([]string, 0, len(children))
+		for _, child := range children {
+			if name, ok := child.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+func (j Join) known(relation string) bool {
+	for _, name := range j.names {
+		if name == relation {
+			return true
+		}
+	}
+	return false
+}
+
+// RelationRequest searches documents of one relation of the join field by the
+// documents related to them. Path walks from Type to the related documents the
+// Related clauses apply to, down through children for a has_child search and up
+// through parents for a has_parent search. The inline clauses, sorting and
+// paging apply to the returned documents of Type.
+type RelationRequest struct {
+	Request
+	Type    string   `json:"type"`
+	Path    []string `json:"path"`
+	Related Clauses  `json:"related"`
+	// InnerHits returns up to this many related documents with every hit at each
+	// level of the path, 0 returns none
+	InnerHits int `json:"innerHits,omitempty"`
+}
+
+// HasChild translates the request into a search for documents of Type that have
+// children, along Path, matching the Related clauses
+func (req RelationRequest) HasChild(fields Fields, join Join) (map[string]interface{}, error) {
+	return req.build(fields, join, false)
+}
+
+// HasParent translates the request into a search for documents of Type whose
+// parents, along Path, match the Related clauses
+func (req RelationRequest) HasParent(fields Fields, join Join) (map[string]interface{}, error) {
+	return req.build(fields, join, true)
+}
+
+func (req RelationRequest) build(fields Fields, join Join, parents bool) (map[string]interface{}, error) {
+	if join.Field == "" {
+		return nil, invalid("the index has no join field")
+	}
+	if !join.known(req.Type) {
+		return nil, invalid("unknown type %q, types are %s", req.Type, strings.Join(join.names, ", "))
+	}
+	if len(req.Path) == 0 {
+		return nil, invalid("path needs at least one related type")
+	}
+	if req.Paginate != "" {
+		return nil, invalid("relationship searches are paged with from and size")
+	}
+	if req.InnerHits < 0 || req.InnerHits > maxInnerHits {
+		return nil, invalid("innerHits must be between 0 and %d", maxInnerHits)
+	}
+
+	// Each step of the path has to be a child, or the parent, of the one before
+	previous := req.Type
+	for _, relation := range req.Path {
+		if parents && join.parents[previous] != relation {
+			return nil, invalid("%s is not the parent of %s", relation, previous)
+		}
+		if !parents && join.parents[relation] != previous {
+			return nil, invalid("%s is not a child of %s", relation, previous)
+		}
+		previous = relation
+	}
+
+	related, err := req.Related.Query(fields)
+	if err != nil {
+		return nil, fmt.Errorf("%w (related)", err)
+	}
+	own, err := req.Query(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	// Wrap the related query from the end of the path back to the returned type.
+	// Inner hits nest the same way, so every hit carries its related documents.
+	for i := len(req.Path) - 1; i >= 0; i-- {
+		var relation map[string]interface{}
+		if parents {
+			relation = map[string]interface{}{
+				"parent_type": req.Path[i],
+				"query":       related,
+			}
+		} else {
+			relation = map[string]interface{}{
+				"type":  req.Path[i],
+				"query": related,
+			}
+		}
+		if req.InnerHits > 0 {
+			relation["inner_hits"] = map[string]interface{}{"size": req.InnerHits}
+		}
+
+		if parents {
+			related = map[string]interface{}{"has_parent": relation}
+		} else {
+			related = map[string]interface{}{"has_child": relation}
+		}
+	}
+
+	query := map[string]interface{}{
+		"bool": map[string]interface{}{
+			"must": []interface{}{related, own},
+			"filter": []interface{}{
+				map[string]interface{}{"term": map[string]interface{}{join.Field: req.Type}},
+			},
+		},
+	}
+	return req.body(query, fields)
+}
@@ -0,0 +1,65 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/girish332/bigdata/elastic"
+	"strings"
+	"testing"
+)
+
+func TestHasChildNestsAlongThePath(t *testing.T) {
+	mapping := elastic.Mapping()
+	var req RelationRequest
+	err := Decode(strings.NewReader(`{
+		"type": "plan",
+		"path": ["linkedPlanServices", "planserviceCostShares"],
+		"related": {"filter": [{"range": {"field": "copay", "lt": 10}}]},
+		"innerHits": 3
+	}`), &req)
+	if err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	body, err := req.HasChild(NewFields(mapping), NewJoin(mapping))
+	if err != nil {
+		t.Fatalf("HasChild() error = %v", err)
+	}
+
+	got, _ := json.Marshal(body["query"])
+	want := `{"bool":{"filter":[{"term":{"plan_join":"plan"}}],"must":[` +
+		`{"has_child":{"inner_hits":{"size":3},"query":` +
+		`{"has_child":{"inner_hits":{"size":3},"query":{"bool":{"filter":[{"range":{"copay":{"lt":10}}}]}},"type":"planserviceCostShares"}},` +
+		`"type":"linkedPlanServices"}},` +
+		`{"match_all":{}}]}}`
+	if string(got) != want {
+		t.Errorf("HasChild() query = %s, want %s", got, want)
+	}
+}
+
+func TestHasParentChecksThePath(t *testing.T) {
+	mapping := elastic.Mapping()
+	fields, join := NewFields(mapping), NewJoin(mapping)
+
+	req := RelationRequest{Type: "linkedService", Path: []string{"linkedPlanServices", "plan"}}
+	body, err := req.HasParent(fields, join)
+	if err != nil {
+		t.Fatalf("HasParent() error = %v", err)
+	}
+	got, _ := json.Marshal(body["query"])
+	if !strings.Contains(string(got), `{"has_parent":{"parent_type":"linkedPlanServices","query":{"has_parent":{"parent_type":"plan"`) {
+		t.Errorf("HasParent() query = %s, want has_parent of linkedPlanServices wrapping plan", got)
+	}
+
+	invalid := map[string]RelationRequest{
+		"skipped level":  {Type: "linkedService", Path: []string{"plan"}},
+		"wrong way":      {Type: "plan", Path: []string{"linkedPlanServices"}},
+		"unknown type":   {Type: "service", Path: []string{"plan"}},
+		"empty path":     {Type: "linkedService"},
+		"many innerHits": {Type: "linkedService", Path: []string{"linkedPlanServices"}, InnerHits: 1000},
+	}
+	for name, req := range invalid {
+		if _, err := req.HasParent(fields, join); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: HasParent() error = %v, want ErrInvalidQuery", name, err)
+		}
+	}
+}
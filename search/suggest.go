@@ -0,0 +1,136 @@
+package search
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	DefaultSuggestions = 10
+	MaxSuggestions     = 50
+	maxSuggestText     = 100
+)
+
+// Suggest completes the text typed so far against the values of a field of
+// one relation. The field needs a search_as_you_type multi-field named suggest
+// and a keyword multi-field named keyword, such as linkedService name.
+type Suggest struct {
+	Type  string
+	Field string
+	Text  string
+	Size  int
+}
+
+// Suggestion is a distinct value of the field along with the number of plans
+// with a document holding it
+type Suggestion struct {
+	Value string `json:"value"`
+	Plans int64  `json:"plans"`
+}
+
+// Build validates the suggest and translates it into the body of a search that
+// only returns aggregations. Matching documents are grouped by their exact
+// value, the most used first, and every group is walked up the join to the
+// plans that hold it, whose number is the doc_count of the last parent step.
+func (s Suggest) Build(fields Fields, join Join) (map[string]interface{}, error) {
+	text := strings.TrimSpace(s.Text)
+	if text == "" {
+		return nil, invalid("the text to complete is empty")
+	}
+	if len(text) > maxSuggestText {
+		return nil, invalid("the text to complete can be at most %d characters", maxSuggestText)
+	}
+	size := s.Size
+	if size == 0 {
+		size = DefaultSuggestions
+	}
+	if size < 0 || size > MaxSuggestions {
+		return nil, invalid("size must be between 1 and %d", MaxSuggestions)
+	}
+	if fields[s.Field+".suggest"] != "search_as_you_type" || fields[s.Field+".keyword"] != "keyword" {
+		return nil, invalid("%s cannot be completed", s.Field)
+	}
+	if !join.known(s.Type) {
+		return nil, invalid("unknown type %q", s.Type)
+	}
+
+	ancestors := join.ancestors(s.Type)
+	steps, err := join.between(s.Type, ancestors[len(ancestors)-1])
+	if err != nil {
+		return nil, err
+	}
+	var aggs map[string]interface{}
+	for i := len(steps) - 1; i >= 0; i-- {
+		aggs = map[string]interface{}{"related": steps[i].aggregation(aggs)}
+	}
+	values := map[string]interface{}{
+		"terms": map[string]interface{}{"field": s.Field + ".keyword", "size": size},
+	}
+	if aggs != nil {
+		values["aggs"] = aggs
+	}
+
+	suggest := s.Field + ".suggest"
+	return map[string]interface{}{
+		"size": 0,
+		"query": map[string]interface{}{
+			"bool": map[string]interface{}{
+				"must": []interface{}{
+					map[string]interface{}{
+						"multi_match": map[string]interface{}{
+							"query":  text,
+							"type":   "bool_prefix",
+							"fields": []string{suggest, suggest + "._2gram", suggest + "._3gram"},
+						},
+					},
+				},
+				"filter": []interface{}{
+					map[string]interface{}{"term": map[string]interface{}{join.Field: s.Type}},
+				},
+			},
+		},
+		"aggs": map[string]interface{}{"values": values},
+	}, nil
+}
+
+// Suggestions reads the aggregations of the response to a suggest built by Build
+func (s Suggest) Suggestions(aggregations json.RawMessage) ([]Suggestion, error) {
+	var root struct {
+		Values struct {
+			Buckets []map[string]json.RawMessage `json:"buckets"`
+		} `json:"values"`
+	}
+	err := json.Unmarshal(aggregations, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]Suggestion, 0, len(root.Values.Buckets))
+	for _, bucket := range root.Values.Buckets {
+		var suggestion Suggestion
+		err := json.Unmarshal(bucket["key"], &suggestion.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		// Follow the parent steps up to the plans
+		aggregation := bucket
+		for {
+			err := json.Unmarshal(aggregation["doc_count"], &suggestion.Plans)
+			if err != nil {
+				return nil, err
+			}
+			next, ok := aggregation["related"]
+			if !ok {
+				break
+			}
+			aggregation = nil
+			err = json.Unmarshal(next, &aggregation)
+			if err != nil {
+				return nil, err
+			}
+		}
+		suggestions = append(suggestions, suggestion)
+	}
+	return suggestions, nil
+}
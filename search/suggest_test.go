@@ -0,0 +1,56 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/girish332/bigdata/elastic"
+	"reflect"
+	"testing"
+)
+
+func TestSuggestCountsPlansPerValue(t *testing.T) {
+	mapping := elastic.Mapping()
+	fields, join := NewFields(mapping), NewJoin(mapping)
+
+	suggest := Suggest{Type: "linkedService", Field: "name", Text: " well ba "}
+	body, err := suggest.Build(fields, join)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	query, _ := json.Marshal(body["query"])
+	wantQuery := `{"bool":{"filter":[{"term":{"plan_join":"linkedService"}}],"must":[{"multi_match":` +
+		`{"fields":["name.suggest","name.suggest._2gram","name.suggest._3gram"],"query":"well ba","type":"bool_prefix"}}]}}`
+	if string(query) != wantQuery {
+		t.Errorf("Build() query = %s, want %s", query, wantQuery)
+	}
+	aggs, _ := json.Marshal(body["aggs"])
+	wantAggs := `{"values":{"aggs":{"related":{"aggs":{"related":{"parent":{"type":"linkedPlanServices"}}},` +
+		`"parent":{"type":"linkedService"}}},"terms":{"field":"name.keyword","size":10}}}`
+	if string(aggs) != wantAggs {
+		t.Errorf("Build() aggs = %s, want %s", aggs, wantAggs)
+	}
+
+	aggregations := `{"values": {"buckets": [
+		{"key": "well baby", "doc_count": 4, "related": {"doc_count": 4, "related": {"doc_count": 3}}},
+		{"key": "Well Baby", "doc_count": 1, "related": {"doc_count": 1, "related": {"doc_count": 1}}}
+	]}}`
+	suggestions, err := suggest.Suggestions(json.RawMessage(aggregations))
+	if err != nil {
+		t.Fatalf("Suggestions() error = %v", err)
+	}
+	want := []Suggestion{{Value: "well baby", Plans: 3}, {Value: "Well Baby", Plans: 1}}
+	if !reflect.DeepEqual(suggestions, want) {
+		t.Errorf("Suggestions() = %v, want %v", suggestions, want)
+	}
+
+	invalid := map[string]Suggest{
+		"empty text":   {Type: "linkedService", Field: "name", Text: "  "},
+		"no subfields": {Type: "linkedService", Field: "objectId", Text: "a"},
+		"large size":   {Type: "linkedService", Field: "name", Text: "a", Size: 500},
+	}
+	for name, s := range invalid {
+		if _, err := s.Build(fields, join); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%s: Build() error = %v, want ErrInvalidQuery", name, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/girish332/bigdata/indexer"
+	"github.com/girish332/bigdata/repository"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const consistencyBatch = 500
+
+// DocumentDrift is a document whose indexed state differs from Redis
+type DocumentDrift struct {
+	ID string `json:"id"`
+	// PlanId is the root plan of the document, its routing in the index
+	PlanId string `json:"planId"`
+	// Version is the version of the plan in Redis, 0 if the plan is gone
+	Version int64 `json:"version,omitempty"`
+	// IndexedVersion is the version of the indexed document, 0 if it is missing
+	IndexedVersion int64 `json:"indexedVersion,omitempty"`
+}
+
+// ConsistencyReport lists the drift between the plans in Redis and their
+// documents in the search index
+type ConsistencyReport struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	Plans     int       `json:"plans"`
+	Documents int       `json:"documents"`
+	// Missing documents belong to a plan in Redis but are not indexed
+	Missing []DocumentDrift `json:"missing"`
+	// Stale documents are indexed with content that differs from Redis
+	Stale []DocumentDrift `json:"stale"`
+	// Orphaned documents are indexed but belong to no plan in Redis. Plans that
+	// expired from Redis are orphaned on purpose, Redis is the source of truth.
+	Orphaned []DocumentDrift `json:"orphaned"`
+	// Repaired is set once the drift was repaired, with the plans and
+	// documents that could not be
+	Repaired     bool     `json:"repaired"`
+	RepairErrors []string `json:"repairErrors,omitempty"`
+}
+
+// Consistent reports whether Redis and the index agree
+func (r ConsistencyReport) Consistent() bool {
+	return len(r.Missing) == 0 && len(r.Stale) == 0 && len(r.Orphaned) == 0
+}
+
+// ConsistencyService compares the plans in Redis with the search index
+type ConsistencyService struct {
+	repo repository.RedisRepo
+	ix   *indexer.Indexer
+}
+
+func NewConsistencyService(repo repository.RedisRepo, ix *indexer.Indexer) *ConsistencyService {
+	return &ConsistencyService{
+		repo: repo,
+		ix:   ix,
+	}
+}
+
+// expectedDocument is a document as it should be indexed according to Redis
+type expectedDocument struct {
+	document indexer.Document
+	hash     string
+	version  int64
+}
+
+// Check compares every document in the index with the documents of the plans in
+// Redis, by objectId and by a hash of their content. With repair set, plans with
+// missing or stale documents are indexed again and orphaned documents deleted.
+func (cs *ConsistencyService) Check(ctx context.Context, repair bool) (ConsistencyReport, error) {
+	report := ConsistencyReport{
+		CheckedAt: time.Now().UTC(),
+		Missing:   make([]DocumentDrift, 0),
+		Stale:     make([]DocumentDrift, 0),
+		Orphaned:  make([]DocumentDrift, 0),
+	}
+
+	// Scan the index before reading Redis. A plan written in between then shows up
+	// as missing and is indexed once more on repair, instead of being deleted.
+	indexed := make(map[string]indexer.StoredDocument)
+	err := cs.ix.Scan(ctx, func(document indexer.StoredDocument) error {
+		indexed[document.ID] = document
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to scan the index: %w", err)
+	}
+	report.Documents = len(indexed)
+
+	expected, plans, err := cs.expectedDocuments(ctx)
+	if err != nil {
+		return report, err
+	}
+	report.Plans = plans
+
+	for id, want := range expected {
+		got, ok := indexed[id]
+		if !ok {
+			report.Missing = append(report.Missing, DocumentDrift{ID: id, PlanId: want.document.Routing, Version: want.version})
+			continue
+		}
+		hash, err := contentHash(got.Source)
+		if err != nil {
+			return report, err
+		}
+		if hash != want.hash || got.Routing != want.document.Routing {
+			report.Stale = append(report.Stale, DocumentDrift{ID: id, PlanId: want.document.Routing, Version: want.version, IndexedVersion: got.Version})
+		}
+	}
+	for id, got := range indexed {
+		if _, ok := expected[id]; !ok {
+			report.Orphaned = append(report.Orphaned, DocumentDrift{ID: id, PlanId: got.Routing, IndexedVersion: got.Version})
+		}
+	}
+	sortDrift(report.Missing)
+	sortDrift(report.Stale)
+	sortDrift(report.Orphaned)
+
+	log.Printf("Checked %d plans and %d indexed documents: %d missing, %d stale, %d orphaned",
+		report.Plans, report.Documents, len(report.Missing), len(report.Stale), len(report.Orphaned))
+	if repair && !report.Consistent() {
+		report.RepairErrors = cs.repair(ctx, report, expected, indexed)
+		report.Repaired = true
+	}
+	return report, nil
+}
+
+// expectedDocuments builds the documents of every plan in Redis along with the
+// hash of their content
+func (cs *ConsistencyService) expectedDocuments(ctx context.Context) (map[string]expectedDocument, int, error) {
+	expected := make(map[string]expectedDocument)
+	plans := 0
+	after := ""
+	for {
+		ids, err := cs.repo.ZRangeAfter(ctx, planIndexKey, after, consistencyBatch)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(ids) == 0 {
+			return expected, plans, nil
+		}
+		after = ids[len(ids)-1]
+
+		batch, versions, err := loadPlans(ctx, cs.repo, ids)
+		if err != nil {
+			return nil, 0, err
+		}
+		plans += len(batch)
+		for i, plan := range batch {
+			for _, document := range indexer.Documents(plan) {
+				hash, err := contentHash(document.Body)
+				if err != nil {
+					return nil, 0, err
+				}
+				expected[document.ID] = expectedDocument{document: document, hash: hash, version: versions[i]}
+			}
+		}
+	}
+}
+
+// repair indexes every plan with a missing or stale document again and deletes
+// orphaned documents. Writes use at least the version already indexed, so they
+// replace drifted documents without going below versions the listener wrote.
+func (cs *ConsistencyService) repair(ctx context.Context, report ConsistencyReport, expected map[string]expectedDocument, indexed map[string]indexer.StoredDocument) []string {
+	type write struct {
+		version int64
+		index   []indexer.Document
+		remove  []indexer.Document
+	}
+	writes := make(map[string]*write)
+
+	byPlan := make(map[string][]indexer.Document)
+	for _, want := range expected {
+		byPlan[want.document.Routing] = append(byPlan[want.document.Routing], want.document)
+	}
+
+	// Reindex whole plans, so their documents stay at one version
+	for _, drift := range append(append([]DocumentDrift{}, report.Missing...), report.Stale...) {
+		if _, ok := writes[drift.PlanId]; ok {
+			continue
+		}
+		w := &write{version: drift.Version, index: byPlan[drift.PlanId]}
+		for _, document := range w.index {
+			if got, ok := indexed[document.ID]; ok && got.Version > w.version {
+				w.version = got.Version
+			}
+		}
+		writes[drift.PlanId] = w
+	}
+
+	// Delete orphans one by one, each at its own version
+	for _, drift := range report.Orphaned {
+		version := drift.IndexedVersion
+		current, err := cs.repo.Get(ctx, versionKeyPrefix+drift.PlanId)
+		if err == nil {
+			if v, err := strconv.ParseInt(current, 10, 64); err == nil && v > version {
+				version = v
+			}
+		}
+		writes["orphan "+drift.ID] = &write{
+			version: version,
+			remove:  []indexer.Document{{ID: drift.ID, Routing: drift.PlanId}},
+		}
+	}
+
+	// Concurrent writes share _bulk requests
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]string, 0)
+	for key, w := range writes {
+		wg.Add(1)
+		go func(key string, w *write) {
+			defer wg.Done()
+			err := cs.ix.Overwrite(ctx, w.version, w.index, w.remove)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+				mu.Unlock()
+			}
+		}(key, w)
+	}
+	wg.Wait()
+
+	sort.Strings(errs)
+	log.Printf("Repaired %d plans and orphaned documents, %d failed", len(writes)-len(errs), len(errs))
+	return errs
+}
+
+// contentHash hashes the JSON of a document. Round tripping through
+// interface{} makes the documents built from Redis and the _source read from the
+// index encode identically, with sorted keys and the same number formatting.
+func contentHash(body map[string]interface{}) (string, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	var canonical interface{}
+	err = json.Unmarshal(raw, &canonical)
+	if err != nil {
+		return "", err
+	}
+	raw, err = json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha1.Sum(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func sortDrift(drift []DocumentDrift) {
+	sort.Slice(drift, func(i, j int) bool {
+		if drift[i].PlanId != drift[j].PlanId {
+			return drift[i].PlanId < drift[j].PlanId
+		}
+		return drift[i].ID < drift[j].ID
+	})
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/girish332/bigdata/indexer"
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/repository"
+)
+
+func TestContentHashMatchesIndexedSource(t *testing.T) {
+	plan := models.Plan{
+		PlanCostShares: models.PlanCostShares{Deductible: 2000, Copay: 23, ObjectId: "pcs-1", ObjectType: "membercostshare", Org: "example.com"},
+		ObjectId:       "plan-1",
+		ObjectType:     "plan",
+		PlanType:       "inNetwork",
+		CreationDate:   "12-12-2017",
+		Org:            "example.com",
+	}
+
+	for _, document := range indexer.Documents(plan) {
+		// The _source comes back from Elasticsearch as generic JSON
+		raw, err := json.Marshal(document.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var source map[string]interface{}
+		if err := json.Unmarshal(raw, &source); err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := contentHash(document.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := contentHash(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("document %s: hash of the indexed source %s differs from %s", document.ID, got, want)
+		}
+
+		source["copay"] = 1.5
+		if changed, _ := contentHash(source); changed == want {
+			t.Errorf("document %s: changed content hashes the same", document.ID)
+		}
+	}
+}
+
+// consistencyRepo serves plans, versions and the plan index from memory
+type consistencyRepo struct {
+	repository.RedisRepo
+	ids    []string
+	values map[string]string
+}
+
+func (r consistencyRepo) ZRangeAfter(_ context.Context, _ string, after string, count int64) ([]string, error) {
+	ids := make([]string, 0)
+	for _, id := range r.ids {
+		if id > after && int64(len(ids)) < count {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (r consistencyRepo) MGet(_ context.Context, keys ...string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = r.values[key]
+	}
+	return values, nil
+}
+
+func (r consistencyRepo) Get(_ context.Context, key string) (string, error) {
+	value, ok := r.values[key]
+	if !ok {
+		return "", repository.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// fakeIndex serves the scroll of Scan from a fixed set of hits and records the
+// actions of every _bulk request as "action id version/version_type"
+type fakeIndex struct {
+	mu      sync.Mutex
+	hits    []map[string]interface{}
+	actions []string
+}
+
+func (f *fakeIndex) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case r.URL.Path == "/plans/_search":
+		json.NewEncoder(w).Encode(map[string]interface{}{"_scroll_id": "scroll-1", "hits": map[string]interface{}{"hits": f.hits}})
+	case r.URL.Path == "/_search/scroll" && r.Method == http.MethodPost:
+		json.NewEncoder(w).Encode(map[string]interface{}{"_scroll_id": "scroll-1", "hits": map[string]interface{}{"hits": []interface{}{}}})
+	case r.URL.Path == "/_search/scroll":
+		w.Write([]byte(`{"succeeded": true}`))
+	case r.URL.Path == "/_bulk":
+		items := make([]interface{}, 0)
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var meta map[string]struct {
+				ID          string `json:"_id"`
+				Version     int64  `json:"version"`
+				VersionType string `json:"version_type"`
+			}
+			json.Unmarshal(scanner.Bytes(), &meta)
+			for action, m := range meta {
+				if action == "index" {
+					scanner.Scan()
+				}
+				f.actions = append(f.actions, fmt.Sprintf("%s %s %d/%s", action, m.ID, m.Version, m.VersionType))
+				items = append(items, map[string]interface{}{action: map[string]interface{}{"_id": m.ID, "status": http.StatusOK}})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"errors": false, "items": items})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// indexHits returns the scroll hits of the documents of a plan at a version
+func indexHits(t *testing.T, plan models.Plan, version int64) []map[string]interface{} {
+	t.Helper()
+	hits := make([]map[string]interface{}, 0)
+	for _, document := range indexer.Documents(plan) {
+		hits = append(hits, map[string]interface{}{
+			"_id": document.ID, "_routing": document.Routing, "_version": version, "_source": document.Body,
+		})
+	}
+	return hits
+}
+
+func newTestConsistency(t *testing.T, repo consistencyRepo, hits []map[string]interface{}) (*ConsistencyService, *fakeIndex) {
+	t.Helper()
+	fake := &fakeIndex{hits: hits}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	es, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := indexer.DefaultConfig()
+	cfg.FlushInterval = time.Millisecond
+	ix := indexer.New(es, "plans", cfg)
+	t.Cleanup(ix.Close)
+	return NewConsistencyService(repo, ix), fake
+}
+
+func consistencyPlan(objectId string, copay int) models.Plan {
+	return models.Plan{
+		PlanCostShares: models.PlanCostShares{Copay: copay, ObjectId: objectId + "-pcs", ObjectType: "membercostshare"},
+		ObjectId:       objectId,
+		ObjectType:     "plan",
+	}
+}
+
+func TestCheckClassifiesAndRepairsDrift(t *testing.T) {
+	inSync, missing, stale := consistencyPlan("plan-1", 1), consistencyPlan("plan-2", 2), consistencyPlan("plan-4", 4)
+	repo := consistencyRepo{ids: []string{"plan-1", "plan-2", "plan-4"}, values: map[string]string{}}
+	for plan, version := range map[*models.Plan]string{&inSync: "2", &missing: "5", &stale: "4"} {
+		raw, _ := json.Marshal(plan)
+		repo.values[plan.ObjectId] = string(raw)
+		repo.values[versionKeyPrefix+plan.ObjectId] = version
+	}
+
+	hits := indexHits(t, inSync, 2)
+	// The plan document of plan-2 is not indexed, its cost shares were indexed
+	// at a version above the one in Redis
+	hits = append(hits, indexHits(t, missing, 7)[1])
+	// plan-4 is indexed with an older copay
+	hits = append(hits, indexHits(t, consistencyPlan("plan-4", 40), 3)...)
+	// ghost-1 belongs to a plan that was never in Redis
+	hits = append(hits, map[string]interface{}{"_id": "ghost-1", "_routing": "plan-9", "_version": 6, "_source": map[string]interface{}{}})
+
+	cs, fake := newTestConsistency(t, repo, hits)
+	report, err := cs.Check(context.Background(), false)
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	if report.Plans != 3 || report.Documents != 6 {
+		t.Errorf("Check() counted %d plans and %d documents, want 3 and 6", report.Plans, report.Documents)
+	}
+	if want := []DocumentDrift{{ID: "plan-2", PlanId: "plan-2", Version: 5}}; !reflect.DeepEqual(report.Missing, want) {
+		t.Errorf("Missing = %+v, want %+v", report.Missing, want)
+	}
+	if want := []DocumentDrift{{ID: "plan-4-pcs", PlanId: "plan-4", Version: 4, IndexedVersion: 3}}; !reflect.DeepEqual(report.Stale, want) {
+		t.Errorf("Stale = %+v, want %+v", report.Stale, want)
+	}
+	if want := []DocumentDrift{{ID: "ghost-1", PlanId: "plan-9", IndexedVersion: 6}}; !reflect.DeepEqual(report.Orphaned, want) {
+		t.Errorf("Orphaned = %+v, want %+v", report.Orphaned, want)
+	}
+	if report.Repaired || len(fake.actions) != 0 {
+		t.Errorf("Check() without repair wrote %v", fake.actions)
+	}
+
+	report, err = cs.Check(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Check() with repair error = %v", err)
+	}
+	if !report.Repaired || len(report.RepairErrors) != 0 {
+		t.Errorf("Check() repaired = %t with errors %v", report.Repaired, report.RepairErrors)
+	}
+	sort.Strings(fake.actions)
+	// Whole plans are written at the higher of their Redis and indexed versions
+	want := []string{
+		"delete ghost-1 6/external_gte",
+		"index plan-2 7/external_gte",
+		"index plan-2-pcs 7/external_gte",
+		"index plan-4 4/external_gte",
+		"index plan-4-pcs 4/external_gte",
+	}
+	if !reflect.DeepEqual(fake.actions, want) {
+		t.Errorf("repair actions = %v, want %v", fake.actions, want)
+	}
+}
+
+func TestCheckRemovesExpiredPlans(t *testing.T) {
+	// plan-3 expired from Redis, its id stays in the plan index and its version
+	// key does not expire
+	expired := consistencyPlan("plan-3", 3)
+	repo := consistencyRepo{ids: []string{"plan-3"}, values: map[string]string{versionKeyPrefix + "plan-3": "3"}}
+
+	cs, fake := newTestConsistency(t, repo, indexHits(t, expired, 2))
+	report, err := cs.Check(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Check() error = %v", err)
+	}
+	want := []DocumentDrift{
+		{ID: "plan-3", PlanId: "plan-3", IndexedVersion: 2},
+		{ID: "plan-3-pcs", PlanId: "plan-3", IndexedVersion: 2},
+	}
+	if report.Plans != 0 || !reflect.DeepEqual(report.Orphaned, want) {
+		t.Errorf("Check() = %d plans, orphaned %+v, want 0 plans and %+v", report.Plans, report.Orphaned, want)
+	}
+
+	// Deleted at the version in Redis, above the indexed one
+	sort.Strings(fake.actions)
+	wantActions := []string{"delete plan-3 3/external_gte", "delete plan-3-pcs 3/external_gte"}
+	if !reflect.DeepEqual(fake.actions, wantActions) {
+		t.Errorf("repair actions = %v, want %v", fake.actions, wantActions)
+	}
+}
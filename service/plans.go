@@ -3,26 +3,92 @@ package service
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/elastic/go-elasticsearch/v8"
-	"github.com/elastic/go-elasticsearch/v8/esapi"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/girish332/bigdata/middleware"
 	"github.com/girish332/bigdata/models"
-	"github.com/girish332/bigdata/rabbitmq"
+	"github.com/girish332/bigdata/outbox"
+	"github.com/girish332/bigdata/patch"
 	"github.com/girish332/bigdata/repository"
 	log "github.com/sirupsen/logrus"
-	"github.com/streadway/amqp"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	// planIndexKey is a sorted set holding the objectId of every stored plan
+	planIndexKey = "plans:index"
+	// planIndexBackfilledKey marks that the plans stored before planIndexKey
+	// existed were added to it
+	planIndexBackfilledKey = "plans:index:backfilled"
+	// backfillBatch is the number of keys scanned at a time by BackfillPlanIndex
+	backfillBatch = 500
+	// versionKeyPrefix namespaces the version counter of each plan
+	versionKeyPrefix = "version:"
+)
+
+var (
+	ErrInvalidCursor        = errors.New("invalid cursor")
+	ErrPlanNotFound         = errors.New("plan not found")
+	ErrPlanExists           = errors.New("plan already exists")
+	ErrObjectIdChanged      = errors.New("objectId of a plan cannot be changed")
+	ErrObjectIdInUse        = errors.New("objectId is already used by another plan")
+	ErrInvalidPlan          = errors.New("patched plan is invalid")
+	ErrPreconditionFailed   = errors.New("If-Match does not match the current ETag of the plan")
+	ErrPreconditionRequired = errors.New("If-Match header is required to modify a plan")
+	// ErrConflict is returned when the plan was modified by another request mid write
+	ErrConflict = repository.ErrTxConflict
+	// errNotAPlan is returned by readPlan for a key holding a child object of a plan
+	errNotAPlan = errors.New("key holds a child object of a plan")
+)
+
+// reservedPrefixes are the namespaces of the keys kept next to the plan objects,
+// which are stored under their bare objectId. No objectId may start with one.
+var reservedPrefixes = []string{
+	namespace(planIndexKey),
+	versionKeyPrefix,
+	schemaKeyPrefix,
+	namespace(reindexStateKey),
+	namespace(outbox.Key),
+}
+
+func namespace(key string) string {
+	prefix, _, _ := strings.Cut(key, ":")
+	return prefix + ":"
+}
+
+// reservedPrefix returns the reserved prefix an objectId starts with, if any
+func reservedPrefix(objectId string) (string, bool) {
+	for _, prefix := range reservedPrefixes {
+		if strings.HasPrefix(objectId, prefix) {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// Precondition is checked against the stored plan, or nil if there is none,
+// inside the write transaction before a plan is replaced or deleted.
+type Precondition func(existing *models.Plan) error
+
 type PlansService struct {
-	repo repository.RedisRepo
+	repo    repository.RedisRepo
+	schemas *SchemaService
+	relay   *outbox.Relay
 }
 
-func NewPlansService(repo repository.RedisRepo) *PlansService {
+func NewPlansService(repo repository.RedisRepo, schemas *SchemaService, relay *outbox.Relay) *PlansService {
 	return &PlansService{
-		repo: repo,
+		repo:    repo,
+		schemas: schemas,
+		relay:   relay,
 	}
 }
 
@@ -30,14 +96,25 @@ type Service interface {
 	GetAnyObject(c *gin.Context, key string) (interface{}, error)
 	GetPlan(c *gin.Context, key string) (models.Plan, error)
 	CreatePlan(c *gin.Context, plan models.Plan) error
-	DeletePlan(c *gin.Context, objectId string) error
-	GetAllPlans(ctx *gin.Context) ([]models.Plan, error)
-	PatchPlan(c *gin.Context, key string, plan models.Plan) error
-	UpdatePlan(c *gin.Context, objectId string, plan models.Plan) error
+	DeletePlan(c *gin.Context, objectId string, pre Precondition) error
+	GetAllPlans(ctx *gin.Context, cursor string, limit int64) (models.PlanPage, error)
+	PatchPlan(c *gin.Context, key string, p patch.Patch, pre Precondition) (models.Plan, error)
+	UpdatePlan(c *gin.Context, objectId string, plan models.Plan, pre Precondition) error
+}
+
+// ValidateDocument checks a raw plan document against the registered schemas
+func (ps *PlansService) ValidateDocument(c *gin.Context, doc []byte) error {
+	return ps.schemas.Validate(c, doc)
 }
 
 func (ps *PlansService) GetAnyObject(c *gin.Context, key string) (interface{}, error) {
+	if _, ok := reservedPrefix(key); ok {
+		return nil, ErrPlanNotFound
+	}
 	value, err := ps.repo.Get(c, key)
+	if errors.Is(err, repository.ErrKeyNotFound) {
+		return nil, ErrPlanNotFound
+	}
 	if err != nil {
 		log.Printf("Error getting the plan from the redis : %v", err)
 		return nil, err
@@ -103,180 +180,96 @@ func (ps *PlansService) GetPlan(c *gin.Context, key string) (models.Plan, error)
 }
 
 func (ps *PlansService) CreatePlan(c *gin.Context, plan models.Plan) error {
-	rmq := &rabbitmq.Factory{}
-
-	conn, err := rmq.NewConnection()
-	if err != nil {
-		log.Errorf("Error creating new connection : %v", err)
-		return err
-	}
-	defer conn.Close()
-
-	ch, err := rmq.NewChannel(conn)
-	if err != nil {
-		log.Errorf("Error creating new channel : %v", err)
-		return err
-	}
-	defer ch.Close()
-
-	// Declare a queue
-	queue, err := ch.QueueDeclare(
-		"plan_queue", // name
-		false,        // durable
-		true,         // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
-	if err != nil {
-		log.Fatalf("Failed to declare a queue: %v", err)
-		return err
-	}
-
-	// Add Code to marshal the struct into a string and set it in the redis
-	objectId := plan.ObjectId
-
-	// Marshal the struct into a string
-	value, err := json.Marshal(plan)
-	if err != nil {
-		log.Errorf("Error marshalling the plan struct : %v", err)
-		return err
-	}
-	err = ps.repo.Set(c, objectId, string(value))
+	_, err := ps.writePlan(c, plan.ObjectId, models.OperationCreate, func(existing *models.Plan) (models.Plan, error) {
+		if existing != nil {
+			return models.Plan{}, ErrPlanExists
+		}
+		return plan, nil
+	})
 	if err != nil {
 		log.Printf("Error setting the plan in the redis : %v", err)
 		return err
 	}
 
-	// Publish the plan onto the queue
-	err = ch.Publish(
-		"",         // exchange
-		queue.Name, // routing key
-		false,      // mandatory
-		false,      // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        value,
-		})
-	if err != nil {
-		log.Fatalf("Failed to publish a message: %v", err)
-		return err
-	}
-
-	pValue, err := json.Marshal(plan.PlanCostShares)
-	if err != nil {
-		log.Errorf("Error marshalling the plan struct : %v", err)
-		return err
-	}
-	err = ps.repo.Set(c, plan.PlanCostShares.ObjectId, string(pValue))
-	if err != nil {
-		log.Printf("Error setting the plan in the redis : %v", err)
-		return err
-	}
+	ps.relay.Notify()
+	return nil
+}
 
-	// Iterate over the linkedPlanServices array and set each object in Redis
-	for _, linkedPlanService := range plan.LinkedPlanServices {
-		// Marshal and store the entire linkedPlanService object in Redis
-		linkedPlanServiceValue, err := json.Marshal(linkedPlanService)
-		if err != nil {
-			log.Errorf("Error marshalling the linkedPlanService struct : %v", err)
-			return err
+func (ps *PlansService) DeletePlan(c *gin.Context, objectId string, pre Precondition) error {
+	err := ps.repo.Tx(c, []string{objectId}, func(tx repository.RedisTx) error {
+		plan, err := readPlan(tx, objectId)
+		if errors.Is(err, errNotAPlan) {
+			return ErrPlanNotFound
 		}
-
-		err = ps.repo.Set(c, linkedPlanService.ObjectId, string(linkedPlanServiceValue))
 		if err != nil {
 			return err
 		}
-
-		// Marshal and store the linkedService object in Redis
-		linkedServiceValue, err := json.Marshal(linkedPlanService.LinkedService)
-		if err != nil {
-			log.Errorf("Error marshalling the linkedService struct : %v", err)
+		if err := pre(plan); err != nil {
 			return err
 		}
 
-		err = ps.repo.Set(c, linkedPlanService.LinkedService.ObjectId, string(linkedServiceValue))
-		if err != nil {
-			return err
+		// Remove the plan along with every child object stored under its own key
+		for _, key := range planKeys(*plan) {
+			tx.Delete(key)
 		}
+		tx.ZRem(planIndexKey, objectId)
 
-		// Marshal and store the planserviceCostShares object in Redis
-		planserviceCostSharesValue, err := json.Marshal(linkedPlanService.PlanServiceCostShares)
+		// The version outlives the plan so a recreated plan keeps counting up
+		version, err := nextVersion(tx, objectId, planKeys(*plan))
 		if err != nil {
-			log.Errorf("Error marshalling the planserviceCostShares struct : %v", err)
 			return err
 		}
-
-		err = ps.repo.Set(c, linkedPlanService.PlanServiceCostShares.ObjectId, string(planserviceCostSharesValue))
+		event, err := newPlanEvent(c, models.OperationDelete, *plan, version, nil)
 		if err != nil {
 			return err
 		}
-	}
-
-	return nil
-}
-
-func (ps *PlansService) DeletePlan(c *gin.Context, objectId string) error {
-	// Fetch the plan
-	plan, err := ps.GetPlan(c, objectId)
-	if err != nil {
-		log.Printf("Error getting the plan from the redis : %v", err)
-		return err
-	}
-
-	// Delete the plan
-	err = ps.repo.Delete(c, objectId)
+		return outbox.Enqueue(tx, event)
+	})
 	if err != nil {
 		log.Printf("Error deleting the plan from the redis : %v", err)
 		return err
 	}
 
-	// Delete the PlanCostShares
-	err = ps.repo.Delete(c, plan.PlanCostShares.ObjectId)
-	if err != nil {
-		log.Printf("Error deleting the PlanCostShares from the redis : %v", err)
-		return err
-	}
-
-	// Delete each LinkedPlanService and its related objects
-	for _, linkedPlanService := range plan.LinkedPlanServices {
-		// Delete the LinkedPlanService
-		err = ps.repo.Delete(c, linkedPlanService.ObjectId)
-		if err != nil {
-			log.Printf("Error deleting the LinkedPlanService from the redis : %v", err)
-			//return err
-		}
+	// Let the listener remove the plan and its children from the search index
+	ps.relay.Notify()
+	return nil
+}
 
-		// Delete the LinkedService
-		err = ps.repo.Delete(c, linkedPlanService.LinkedService.ObjectId)
+func (ps *PlansService) GetAllPlans(ctx *gin.Context, cursor string, limit int64) (models.PlanPage, error) {
+	after := ""
+	if cursor != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(cursor)
 		if err != nil {
-			log.Printf("Error deleting the LinkedService from the redis : %v", err)
-			return err
+			return models.PlanPage{}, ErrInvalidCursor
 		}
+		after = string(decoded)
+	}
 
-		// Delete the PlanServiceCostShares
-		err = ps.repo.Delete(c, linkedPlanService.PlanServiceCostShares.ObjectId)
-		if err != nil {
-			log.Printf("Error deleting the PlanServiceCostShares from the redis : %v", err)
-			return err
-		}
+	// Fetch one extra id so we know whether there is another page
+	ids, err := ps.repo.ZRangeAfter(ctx, planIndexKey, after, limit+1)
+	if err != nil {
+		log.Printf("Error reading the plan index from the redis : %v", err)
+		return models.PlanPage{}, err
 	}
 
-	return nil
-}
+	page := models.PlanPage{Plans: make([]models.Plan, 0, len(ids))}
+	if int64(len(ids)) > limit {
+		ids = ids[:limit]
+		page.Next = base64.RawURLEncoding.EncodeToString([]byte(ids[len(ids)-1]))
+	}
 
-func (ps *PlansService) GetAllPlans(ctx *gin.Context) ([]models.Plan, error) {
-	plans := make([]models.Plan, 0)
-	keys, err := ps.repo.Keys(ctx, "*")
+	values, err := ps.repo.MGet(ctx, ids...)
 	if err != nil {
-		log.Printf("Error fetching all the keys from the redis : %v", err)
-		return nil, err
-	}
-	for _, key := range keys {
-		value, err := ps.repo.Get(ctx, key)
-		if err != nil {
-			log.Printf("Error fetching the value from the redis : %v", err)
-			return nil, err
+		log.Printf("Error fetching the plans from the redis : %v", err)
+		return models.PlanPage{}, err
+	}
+	for i, value := range values {
+		if value == "" {
+			// The plan expired or was removed without updating the index
+			if err := ps.repo.ZRem(ctx, planIndexKey, ids[i]); err != nil {
+				log.Printf("Error removing stale plan %s from the index : %v", ids[i], err)
+			}
+			continue
 		}
 
 		var plan models.Plan
@@ -285,207 +278,385 @@ func (ps *PlansService) GetAllPlans(ctx *gin.Context) ([]models.Plan, error) {
 			log.Printf("Error unmarshalling the plan from the redis : %v", err)
 			continue
 		}
-
-		if plan.ObjectId != "" && plan.ObjectType != "" && plan.PlanCostShares.ObjectId != "" {
-			plans = append(plans, plan)
-		}
+		page.Plans = append(page.Plans, plan)
 	}
 
-	return plans, nil
+	return page, nil
 }
 
-func (ps *PlansService) PatchPlan(c *gin.Context, key string, newPlan models.Plan) error {
-	existingPlan, err := ps.GetPlan(c, key)
-	if err != nil || existingPlan.ObjectId == "" {
+// BackfillPlanIndex adds the plans stored before the plan index existed to it.
+// It scans the whole keyspace once for objects of objectType plan and records
+// when it is done, so later calls return right away.
+func BackfillPlanIndex(ctx context.Context, repo repository.RedisRepo) error {
+	_, err := repo.Get(ctx, planIndexBackfilledKey)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, repository.ErrKeyNotFound) {
 		return err
 	}
 
-	// Create a map of new LinkedPlanServices for easy lookup
-	newLinkedPlanServices := make(map[string]models.LinkedPlanService)
-	for _, newLinkedPlanService := range newPlan.LinkedPlanServices {
-		newLinkedPlanServices[newLinkedPlanService.ObjectId] = newLinkedPlanService
-	}
+	added := 0
+	var cursor uint64
+	for {
+		keys, next, err := repo.Scan(ctx, cursor, backfillBatch)
+		if err != nil {
+			return err
+		}
+		candidates := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if _, ok := reservedPrefix(key); !ok {
+				candidates = append(candidates, key)
+			}
+		}
+		values, err := repo.MGet(ctx, candidates...)
+		if err != nil {
+			return err
+		}
+		for i, value := range values {
+			var object struct {
+				ObjectType string `json:"objectType"`
+			}
+			if err := json.Unmarshal([]byte(value), &object); err != nil || object.ObjectType != planLayout.objectType {
+				continue
+			}
+			if err := repo.ZAdd(ctx, planIndexKey, candidates[i]); err != nil {
+				return err
+			}
+			added++
+		}
 
-	// Update existing LinkedPlanServices if they are in the newLinkedPlanServices map
-	for i, existingLinkedPlanService := range existingPlan.LinkedPlanServices {
-		if newLinkedPlanService, ok := newLinkedPlanServices[existingLinkedPlanService.ObjectId]; ok {
-			existingPlan.LinkedPlanServices[i] = newLinkedPlanService
-			delete(newLinkedPlanServices, existingLinkedPlanService.ObjectId)
+		cursor = next
+		if cursor == 0 {
+			break
 		}
 	}
 
-	// Append any remaining new LinkedPlanServices that were not in the existing plan
-	for _, newLinkedPlanService := range newLinkedPlanServices {
-		existingPlan.LinkedPlanServices = append(existingPlan.LinkedPlanServices, newLinkedPlanService)
-	}
+	log.Printf("Added %d stored plans to the plan index", added)
+	return repo.SetPersistent(ctx, planIndexBackfilledKey, time.Now().UTC().Format(time.RFC3339))
+}
 
-	// Marshal the updated plan into a string
-	value, err := json.Marshal(existingPlan)
-	if err != nil {
-		return err
-	}
+func (ps *PlansService) PatchPlan(c *gin.Context, key string, p patch.Patch, pre Precondition) (models.Plan, error) {
+	event, err := ps.writePlan(c, key, models.OperationPatch, func(existing *models.Plan) (models.Plan, error) {
+		if existing == nil {
+			return models.Plan{}, ErrPlanNotFound
+		}
+		if err := pre(existing); err != nil {
+			return models.Plan{}, err
+		}
 
-	// Update the plan in the database
-	err = ps.repo.Set(c, key, string(value))
+		doc, err := json.Marshal(existing)
+		if err != nil {
+			return models.Plan{}, err
+		}
+		patched, err := p.Apply(doc)
+		if err != nil {
+			return models.Plan{}, err
+		}
+		if err := ps.schemas.Validate(c, patched); err != nil {
+			return models.Plan{}, err
+		}
+		return decodePlan(patched)
+	})
 	if err != nil {
 		log.Errorf("Error updating the plan in the redis : %v", err)
-		return err
+		return models.Plan{}, err
 	}
 
-	// Create a new Elasticsearch client
-	cfg := elasticsearch.Config{
-		Addresses: []string{
-			"http://localhost:9200",
-		},
-	}
-	client, err := elasticsearch.NewClient(cfg)
+	ps.relay.Notify()
+	return event.Payload, nil
+}
+
+func (ps *PlansService) UpdatePlan(c *gin.Context, objectId string, plan models.Plan, pre Precondition) error {
+	// Replace the existing plan and all its associated objects in one transaction
+	_, err := ps.writePlan(c, objectId, models.OperationUpdate, func(existing *models.Plan) (models.Plan, error) {
+		if err := pre(existing); err != nil {
+			return models.Plan{}, err
+		}
+		return plan, nil
+	})
 	if err != nil {
-		log.Errorf("Error creating the client: %s", err)
+		log.Printf("Failed to replace existing plan with error : %v", err.Error())
 		return err
 	}
 
-	// Create an UpdateRequest for Elasticsearch
-	updateReq := esapi.IndexRequest{
-		Index:      "plans",
-		DocumentID: key,
-		Body:       strings.NewReader(string(value)),
-		Refresh:    "true",
-	}
+	ps.relay.Notify()
+	return nil
+}
+
+// writePlan atomically replaces the plan graph stored under objectId with the
+// plan returned by build. build receives the stored plan, or nil if there is none.
+// Child objects of the old plan that are not part of the new one are removed,
+// and ErrObjectIdInUse is returned when a new child key belongs to another plan.
+// It returns the event describing the write, carrying the next version of the plan.
+func (ps *PlansService) writePlan(c *gin.Context, objectId string, operation string, build func(existing *models.Plan) (models.Plan, error)) (models.PlanEvent, error) {
+	var event models.PlanEvent
+	err := ps.repo.Tx(c, []string{objectId}, func(tx repository.RedisTx) error {
+		existing, err := readPlan(tx, objectId)
+		if errors.Is(err, errNotAPlan) {
+			// A patch needs a plan to start from, anything else would replace the
+			// child of another plan with a new plan
+			if operation == models.OperationPatch {
+				return ErrPlanNotFound
+			}
+			return fmt.Errorf("%w: %s", ErrObjectIdInUse, objectId)
+		}
+		if err != nil && !errors.Is(err, ErrPlanNotFound) {
+			return err
+		}
+
+		plan, err := build(existing)
+		if err != nil {
+			return err
+		}
+		if plan.ObjectId != objectId {
+			return ErrObjectIdChanged
+		}
+
+		entries, err := planEntries(plan)
+		if err != nil {
+			return err
+		}
+		if err := claimKeys(tx, existing, entries); err != nil {
+			return err
+		}
+		removed := make([]string, 0)
+		if existing != nil {
+			for _, key := range planKeys(*existing) {
+				if _, ok := entries[key]; !ok {
+					tx.Delete(key)
+					removed = append(removed, key)
+				}
+			}
+		}
+		for key, value := range entries {
+			tx.Set(key, value)
+		}
+		tx.ZAdd(planIndexKey, objectId)
 
-	// Send the Entire Plan Object to Re Index
-	res, err := updateReq.Do(context.Background(), client)
+		children := append(planKeys(plan), removed...)
+		version, err := nextVersion(tx, objectId, children)
+		if err != nil {
+			return err
+		}
+		event, err = newPlanEvent(c, operation, plan, version, removed)
+		if err != nil {
+			return err
+		}
+		// The event is stored together with the plan and delivered by the outbox relay
+		return outbox.Enqueue(tx, event)
+	})
 	if err != nil {
-		return err
+		return models.PlanEvent{}, err
 	}
-	defer res.Body.Close()
 
-	if res.IsError() {
-		log.Println(res.String())
-		return fmt.Errorf("Error updating document ID=%s", key)
-	}
+	return event, nil
+}
 
-	existingPlan.PlanJoin = map[string]interface{}{
-		"name": "plan",
+// claimKeys makes sure every child key of the new plan is either free or already
+// part of the stored plan, so a plan never overwrites the objects of another one.
+// The keys are watched so another plan claiming them first aborts the write.
+func claimKeys(tx repository.RedisTx, existing *models.Plan, entries map[string]string) error {
+	owned := make(map[string]bool)
+	if existing != nil {
+		for _, key := range planKeys(*existing) {
+			owned[key] = true
+		}
 	}
-
-	existingPlan.PlanCostShares.PlanJoin = map[string]interface{}{
-		"name":   "plancostshares",
-		"parent": existingPlan.ObjectId,
+	claimed := make([]string, 0, len(entries))
+	for key := range entries {
+		if !owned[key] {
+			claimed = append(claimed, key)
+		}
 	}
-
-	planCostShareJSON, err := json.Marshal(existingPlan.PlanCostShares)
-	if err != nil {
-		log.Errorf("Failed to index planCostShare with err : %v", err)
+	if len(claimed) == 0 {
+		return nil
 	}
-
-	req := esapi.IndexRequest{
-		Index:      "plans",
-		DocumentID: existingPlan.PlanCostShares.ObjectId,
-		Body:       bytes.NewReader(planCostShareJSON),
-		Refresh:    "true",
-		Routing:    existingPlan.ObjectId,
+	if err := tx.Watch(claimed...); err != nil {
+		return err
 	}
 
-	res, err = req.Do(context.Background(), client)
-	if err != nil {
-		log.Errorf("Failed to index planCostShare with err : %v", err)
+	for _, key := range claimed {
+		_, err := tx.Get(key)
+		if err == nil {
+			return fmt.Errorf("%w: %s", ErrObjectIdInUse, key)
+		}
+		if !errors.Is(err, repository.ErrKeyNotFound) {
+			return err
+		}
 	}
+	return nil
+}
 
-	for _, linkedPlanService := range existingPlan.LinkedPlanServices {
-
-		// Reindex the linkedPlanService and its associated objects
-		linkedPlanService.PlanJoin = map[string]interface{}{
-			"name":   "linkedPlanServices",
-			"parent": existingPlan.ObjectId,
+// nextVersion queues the increment of the version of a plan and returns the new
+// version. Elasticsearch versions every document by its objectId, and a freed
+// child objectId may be claimed by another plan, so the new version is above the
+// last one of the plan and of every given child key, and is recorded for all of
+// them. It relies on the plan key and claimed child keys being watched by the
+// surrounding transaction.
+func nextVersion(tx repository.RedisTx, objectId string, children []string) (int64, error) {
+	keys := append([]string{objectId}, children...)
+	var version int64
+	for _, key := range keys {
+		value, err := tx.Get(versionKeyPrefix + key)
+		if errors.Is(err, repository.ErrKeyNotFound) {
+			continue
 		}
-
-		linkedPlanServiceJSON, err := json.Marshal(linkedPlanService)
 		if err != nil {
-			log.Errorf("Failed to index linkedPlanService with err : %v", err)
+			return 0, err
 		}
-
-		req := esapi.IndexRequest{
-			Index:      "plans",
-			DocumentID: linkedPlanService.ObjectId,
-			Body:       bytes.NewReader(linkedPlanServiceJSON),
-			Refresh:    "true",
-			Routing:    existingPlan.ObjectId,
-		}
-
-		res, err = req.Do(context.Background(), client)
+		stored, err := strconv.ParseInt(value, 10, 64)
 		if err != nil {
-			log.Errorf("Failed to index linkedPlanService with err : %v", err)
+			return 0, err
 		}
-		defer res.Body.Close()
-
-		// Reindex the linkedService and planServiceCostShares objects
-		linkedPlanService.LinkedService.PlanJoin = map[string]interface{}{
-			"name":   "linkedService",
-			"parent": linkedPlanService.ObjectId,
+		if stored > version {
+			version = stored
 		}
+	}
 
-		linkedServiceJSON, err := json.Marshal(linkedPlanService.LinkedService)
-		if err != nil {
-			log.Errorf("Failed to index linkedService with err : %v", err)
-		}
+	version++
+	for _, key := range keys {
+		tx.SetPersistent(versionKeyPrefix+key, strconv.FormatInt(version, 10))
+	}
+	return version, nil
+}
 
-		req = esapi.IndexRequest{
-			Index:      "plans",
-			DocumentID: linkedPlanService.LinkedService.ObjectId,
-			Body:       bytes.NewReader(linkedServiceJSON),
-			Refresh:    "true",
-			Routing:    linkedPlanService.ObjectId,
-		}
+func newPlanEvent(c *gin.Context, operation string, plan models.Plan, version int64, removed []string) (models.PlanEvent, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return models.PlanEvent{}, err
+	}
+
+	return models.PlanEvent{
+		SchemaVersion: models.PlanEventSchemaVersion,
+		EventId:       hex.EncodeToString(id),
+		Operation:     operation,
+		ObjectId:      plan.ObjectId,
+		Version:       version,
+		Timestamp:     time.Now().UTC(),
+		Actor:         c.GetString(middleware.ActorKey),
+		Payload:       plan,
+		Removed:       removed,
+	}, nil
+}
 
-		res, err = req.Do(context.Background(), client)
-		if err != nil {
-			log.Errorf("Failed to index linkedService with err : %v", err)
+// LinkedPlanServicesPatch merges the linkedPlanServices of newPlan into the stored
+// plan by objectId, replacing matching services and appending new ones. This is
+// how PATCH behaves for plain application/json bodies.
+func LinkedPlanServicesPatch(newPlan models.Plan) patch.Patch {
+	return patch.Func(func(doc []byte) ([]byte, error) {
+		var existingPlan models.Plan
+		if err := json.Unmarshal(doc, &existingPlan); err != nil {
+			return nil, err
 		}
-		defer res.Body.Close()
 
-		// Reindex the planServiceCostShares object
-		linkedPlanService.PlanServiceCostShares.PlanJoin = map[string]interface{}{
-			"name":   "planserviceCostShares",
-			"parent": linkedPlanService.ObjectId,
+		// Create a map of new LinkedPlanServices for easy lookup
+		newLinkedPlanServices := make(map[string]models.LinkedPlanService)
+		for _, newLinkedPlanService := range newPlan.LinkedPlanServices {
+			newLinkedPlanServices[newLinkedPlanService.ObjectId] = newLinkedPlanService
 		}
 
-		planServiceCostSharesJSON, err := json.Marshal(linkedPlanService.PlanServiceCostShares)
-		if err != nil {
-			log.Errorf("Failed to index planServiceCostShares with err : %v", err)
+		// Update existing LinkedPlanServices if they are in the newLinkedPlanServices map
+		for i, existingLinkedPlanService := range existingPlan.LinkedPlanServices {
+			if newLinkedPlanService, ok := newLinkedPlanServices[existingLinkedPlanService.ObjectId]; ok {
+				existingPlan.LinkedPlanServices[i] = newLinkedPlanService
+				delete(newLinkedPlanServices, existingLinkedPlanService.ObjectId)
+			}
 		}
 
-		req = esapi.IndexRequest{
-			Index:      "plans",
-			DocumentID: linkedPlanService.PlanServiceCostShares.ObjectId,
-			Body:       bytes.NewReader(planServiceCostSharesJSON),
-			Refresh:    "true",
-			Routing:    linkedPlanService.ObjectId,
+		// Append any remaining new LinkedPlanServices in request order
+		for _, newLinkedPlanService := range newPlan.LinkedPlanServices {
+			if _, ok := newLinkedPlanServices[newLinkedPlanService.ObjectId]; ok {
+				existingPlan.LinkedPlanServices = append(existingPlan.LinkedPlanServices, newLinkedPlanService)
+			}
 		}
 
-		res, err = req.Do(context.Background(), client)
-		if err != nil {
-			log.Errorf("Failed to index planServiceCostShares with err : %v", err)
-		}
-		defer res.Body.Close()
-	}
+		return json.Marshal(existingPlan)
+	})
+}
 
-	return nil
+// decodePlan strictly decodes a patched plan document and runs the same binding
+// validation as plans sent in a request body
+func decodePlan(doc []byte) (models.Plan, error) {
+	var plan models.Plan
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&plan); err != nil {
+		return models.Plan{}, fmt.Errorf("%w: %v", ErrInvalidPlan, err)
+	}
+	if err := binding.Validator.ValidateStruct(&plan); err != nil {
+		return models.Plan{}, fmt.Errorf("%w: %v", ErrInvalidPlan, err)
+	}
+	return plan, nil
 }
 
-func (ps *PlansService) UpdatePlan(c *gin.Context, objectId string, plan models.Plan) error {
-	// Delete the existing plan and all its associated objects
-	err := ps.DeletePlan(c, objectId)
+// readPlan loads the plan stored under objectId inside a transaction. A key
+// holding a child object of a plan is not a plan and returns errNotAPlan.
+func readPlan(tx repository.RedisTx, objectId string) (*models.Plan, error) {
+	if _, ok := reservedPrefix(objectId); ok {
+		return nil, ErrPlanNotFound
+	}
+	value, err := tx.Get(objectId)
+	if errors.Is(err, repository.ErrKeyNotFound) {
+		return nil, ErrPlanNotFound
+	}
 	if err != nil {
-		log.Printf("Failed to delete existing plan with error : %v", err.Error())
-		return err
+		return nil, err
 	}
 
-	// Create a new plan with the new request body
-	err = ps.CreatePlan(c, plan)
+	var plan models.Plan
+	err = json.Unmarshal([]byte(value), &plan)
 	if err != nil {
-		log.Printf("Failed to create new plan with error : %v", err.Error())
-		return err
+		return nil, err
 	}
+	if plan.ObjectType != planLayout.objectType {
+		return nil, errNotAPlan
+	}
+	return &plan, nil
+}
 
-	return nil
+// planEntries flattens a plan into the Redis keys and values it is stored under.
+// Every object of the plan graph is stored on its own under its objectId.
+func planEntries(plan models.Plan) (map[string]string, error) {
+	entries := make(map[string]string)
+	add := func(key string, object interface{}) error {
+		value, err := json.Marshal(object)
+		if err != nil {
+			return err
+		}
+		entries[key] = string(value)
+		return nil
+	}
+
+	if err := add(plan.ObjectId, plan); err != nil {
+		return nil, err
+	}
+	if err := add(plan.PlanCostShares.ObjectId, plan.PlanCostShares); err != nil {
+		return nil, err
+	}
+	for _, linkedPlanService := range plan.LinkedPlanServices {
+		if err := add(linkedPlanService.ObjectId, linkedPlanService); err != nil {
+			return nil, err
+		}
+		if err := add(linkedPlanService.LinkedService.ObjectId, linkedPlanService.LinkedService); err != nil {
+			return nil, err
+		}
+		if err := add(linkedPlanService.PlanServiceCostShares.ObjectId, linkedPlanService.PlanServiceCostShares); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// planKeys returns the Redis keys of every object of the plan graph
+func planKeys(plan models.Plan) []string {
+	keys := []string{plan.ObjectId, plan.PlanCostShares.ObjectId}
+	for _, linkedPlanService := range plan.LinkedPlanServices {
+		keys = append(keys,
+			linkedPlanService.ObjectId,
+			linkedPlanService.LinkedService.ObjectId,
+			linkedPlanService.PlanServiceCostShares.ObjectId,
+		)
+	}
+	return keys
 }
@@ -0,0 +1,341 @@
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/repository"
+)
+
+// memRepo runs transactions against an in memory keyspace and records the
+// keys watched by the last one. index is the plan index, kept sorted.
+type memRepo struct {
+	repository.RedisRepo
+	values  map[string]string
+	index   []string
+	watched []string
+}
+
+func (r *memRepo) Get(_ context.Context, key string) (string, error) {
+	value, ok := r.values[key]
+	if !ok {
+		return "", repository.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (r *memRepo) SetPersistent(_ context.Context, key, value string) error {
+	r.values[key] = value
+	return nil
+}
+
+func (r *memRepo) MGet(_ context.Context, keys ...string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = r.values[key]
+	}
+	return values, nil
+}
+
+// Scan walks the sorted keys two at a time, the cursor is the offset of the next batch
+func (r *memRepo) Scan(_ context.Context, cursor uint64, _ int64) ([]string, uint64, error) {
+	keys := make([]string, 0, len(r.values))
+	for key := range r.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	end := cursor + 2
+	if end >= uint64(len(keys)) {
+		return keys[cursor:], 0, nil
+	}
+	return keys[cursor:end], end, nil
+}
+
+func (r *memRepo) ZAdd(_ context.Context, key, member string) error {
+	for _, m := range r.index {
+		if m == member {
+			return nil
+		}
+	}
+	r.index = append(r.index, member)
+	sort.Strings(r.index)
+	return nil
+}
+
+func (r *memRepo) ZRem(_ context.Context, key, member string) error {
+	for i, m := range r.index {
+		if m == member {
+			r.index = append(r.index[:i], r.index[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *memRepo) ZRangeAfter(_ context.Context, key, after string, count int64) ([]string, error) {
+	members := make([]string, 0)
+	for _, m := range r.index {
+		if m > after && int64(len(members)) < count {
+			members = append(members, m)
+		}
+	}
+	return members, nil
+}
+
+func (r *memRepo) Tx(_ context.Context, watch []string, fn func(tx repository.RedisTx) error) error {
+	tx := &memTx{repo: r}
+	r.watched = append([]string{}, watch...)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for _, op := range tx.queued {
+		op()
+	}
+	return nil
+}
+
+type memTx struct {
+	repo   *memRepo
+	queued []func()
+}
+
+func (t *memTx) Watch(keys ...string) error {
+	t.repo.watched = append(t.repo.watched, keys...)
+	return nil
+}
+
+func (t *memTx) Get(key string) (string, error) {
+	value, ok := t.repo.values[key]
+	if !ok {
+		return "", repository.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+func (t *memTx) Set(key, value string) {
+	t.queued = append(t.queued, func() { t.repo.values[key] = value })
+}
+
+func (t *memTx) SetPersistent(key, value string) { t.Set(key, value) }
+
+func (t *memTx) Delete(key string) {
+	t.queued = append(t.queued, func() { delete(t.repo.values, key) })
+}
+
+func (t *memTx) ZAdd(string, string)  {}
+func (t *memTx) ZRem(string, string)  {}
+func (t *memTx) RPush(string, string) {}
+
+func testPlan(objectId, servicePlanId string) models.Plan {
+	return models.Plan{
+		PlanCostShares: models.PlanCostShares{ObjectId: objectId + "-pcs", ObjectType: "membercostshare"},
+		LinkedPlanServices: []models.LinkedPlanService{{
+			ObjectId:              servicePlanId,
+			ObjectType:            "planservice",
+			LinkedService:         models.LinkedService{ObjectId: servicePlanId + "-ls", ObjectType: "service"},
+			PlanServiceCostShares: models.PlanServiceCostShares{ObjectId: servicePlanId + "-pscs", ObjectType: "membercostshare"},
+		}},
+		ObjectId:   objectId,
+		ObjectType: "plan",
+	}
+}
+
+func TestWritePlanRejectsChildKeysOfAnotherPlan(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	repo := &memRepo{values: map[string]string{}}
+	ps := &PlansService{repo: repo}
+	write := func(plan models.Plan) error {
+		_, err := ps.writePlan(c, plan.ObjectId, models.OperationCreate, func(*models.Plan) (models.Plan, error) {
+			return plan, nil
+		})
+		return err
+	}
+
+	if err := write(testPlan("plan-a", "lps-1")); err != nil {
+		t.Fatalf("write plan-a error = %v", err)
+	}
+	before := repo.values["lps-1"]
+
+	if err := write(testPlan("plan-b", "lps-1")); !errors.Is(err, ErrObjectIdInUse) {
+		t.Fatalf("write plan-b reusing lps-1 error = %v, want ErrObjectIdInUse", err)
+	}
+	if _, ok := repo.values["plan-b"]; ok || repo.values["lps-1"] != before {
+		t.Error("rejected write of plan-b changed the keyspace")
+	}
+
+	// Rewriting a plan keeps its own children and claims the new ones
+	if err := write(testPlan("plan-a", "lps-2")); err != nil {
+		t.Fatalf("rewrite plan-a error = %v", err)
+	}
+	sort.Strings(repo.watched)
+	want := []string{"lps-2", "lps-2-ls", "lps-2-pscs", "plan-a"}
+	if !reflect.DeepEqual(repo.watched, want) {
+		t.Errorf("watched = %v, want %v", repo.watched, want)
+	}
+	if _, ok := repo.values["lps-1"]; ok {
+		t.Error("lps-1 is still stored after plan-a dropped it")
+	}
+	if err := write(testPlan("plan-b", "lps-1")); err != nil {
+		t.Errorf("write plan-b after lps-1 was freed error = %v", err)
+	}
+}
+
+func TestChildKeysAreNotPlans(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	repo := &memRepo{values: map[string]string{}}
+	ps := &PlansService{repo: repo}
+	anyPlan := func(*models.Plan) error { return nil }
+
+	if _, err := ps.writePlan(c, "plan-a", models.OperationCreate, func(*models.Plan) (models.Plan, error) {
+		return testPlan("plan-a", "lps-1"), nil
+	}); err != nil {
+		t.Fatalf("write plan-a error = %v", err)
+	}
+	before := len(repo.values)
+
+	if err := ps.DeletePlan(c, "lps-1", anyPlan); !errors.Is(err, ErrPlanNotFound) {
+		t.Errorf("DeletePlan() of a child error = %v, want ErrPlanNotFound", err)
+	}
+	_, err := ps.writePlan(c, "lps-1", models.OperationUpdate, func(*models.Plan) (models.Plan, error) {
+		return testPlan("lps-1", "lps-9"), nil
+	})
+	if !errors.Is(err, ErrObjectIdInUse) {
+		t.Errorf("update of a child error = %v, want ErrObjectIdInUse", err)
+	}
+	_, err = ps.writePlan(c, "plan-a-pcs", models.OperationPatch, func(*models.Plan) (models.Plan, error) {
+		return testPlan("plan-a-pcs", "lps-9"), nil
+	})
+	if !errors.Is(err, ErrPlanNotFound) {
+		t.Errorf("patch of a child error = %v, want ErrPlanNotFound", err)
+	}
+
+	if len(repo.values) != before || !strings.Contains(repo.values["lps-1"], `"planservice"`) {
+		t.Error("writes to the keys of children changed the keyspace")
+	}
+}
+
+func TestReclaimedChildKeysKeepCountingUp(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	repo := &memRepo{values: map[string]string{}}
+	ps := &PlansService{repo: repo}
+	write := func(plan models.Plan) int64 {
+		t.Helper()
+		event, err := ps.writePlan(c, plan.ObjectId, models.OperationUpdate, func(*models.Plan) (models.Plan, error) {
+			return plan, nil
+		})
+		if err != nil {
+			t.Fatalf("write %s error = %v", plan.ObjectId, err)
+		}
+		return event.Version
+	}
+
+	write(testPlan("plan-a", "lps-1"))
+	write(testPlan("plan-a", "lps-1"))
+	// plan-a drops lps-1, whose documents are deleted at version 3
+	if version := write(testPlan("plan-a", "lps-2")); version != 3 {
+		t.Fatalf("third write of plan-a version = %d, want 3", version)
+	}
+
+	// The first write of plan-b reuses lps-1 and has to outrank its delete
+	if version := write(testPlan("plan-b", "lps-1")); version != 4 {
+		t.Errorf("first write of plan-b version = %d, want 4", version)
+	}
+	for _, key := range []string{"plan-b", "plan-b-pcs", "lps-1", "lps-1-ls", "lps-1-pscs"} {
+		if got := repo.values[versionKeyPrefix+key]; got != "4" {
+			t.Errorf("version of %s = %q, want 4", key, got)
+		}
+	}
+	if got := repo.values[versionKeyPrefix+"plan-a"]; got != "3" {
+		t.Errorf("version of plan-a = %q, want 3", got)
+	}
+}
+
+func TestGetAllPlansPages(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	cursor := func(objectId string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(objectId))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+		limit  int64
+		want   []string
+		next   string
+		err    error
+	}{
+		{name: "first page", limit: 2, want: []string{"plan-1", "plan-2"}, next: cursor("plan-2")},
+		// plan-3 expired, the page is short but the cursor still moves past it
+		{name: "page with an expired plan", cursor: cursor("plan-2"), limit: 2, want: []string{"plan-4"}, next: cursor("plan-4")},
+		{name: "last page", cursor: cursor("plan-4"), limit: 2, want: []string{"plan-5"}},
+		{name: "exactly the rest", cursor: cursor("plan-3"), limit: 2, want: []string{"plan-4", "plan-5"}},
+		{name: "past the end", cursor: cursor("plan-5"), limit: 2, want: []string{}},
+		{name: "invalid cursor", cursor: "not base64!", limit: 2, err: ErrInvalidCursor},
+	}
+	for _, tt := range tests {
+		repo := &memRepo{values: map[string]string{}, index: []string{"plan-1", "plan-2", "plan-3", "plan-4", "plan-5"}}
+		for _, objectId := range []string{"plan-1", "plan-2", "plan-4", "plan-5"} {
+			repo.values[objectId] = `{"objectId": "` + objectId + `", "objectType": "plan"}`
+		}
+		ps := &PlansService{repo: repo}
+
+		page, err := ps.GetAllPlans(c, tt.cursor, tt.limit)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Errorf("%s: GetAllPlans() error = %v, want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GetAllPlans() error = %v", tt.name, err)
+			continue
+		}
+		got := make([]string, 0, len(page.Plans))
+		for _, plan := range page.Plans {
+			got = append(got, plan.ObjectId)
+		}
+		if !reflect.DeepEqual(got, tt.want) || page.Next != tt.next {
+			t.Errorf("%s: GetAllPlans() = %v next %q, want %v next %q", tt.name, got, page.Next, tt.want, tt.next)
+		}
+		if tt.name == "page with an expired plan" && !reflect.DeepEqual(repo.index, []string{"plan-1", "plan-2", "plan-4", "plan-5"}) {
+			t.Errorf("%s: index = %v, want the expired plan removed", tt.name, repo.index)
+		}
+	}
+}
+
+func TestBackfillPlanIndexAddsStoredPlansOnce(t *testing.T) {
+	repo := &memRepo{values: map[string]string{
+		"plan-1":         `{"objectId": "plan-1", "objectType": "plan"}`,
+		"plan-1-pcs":     `{"objectId": "plan-1-pcs", "objectType": "membercostshare"}`,
+		"plan-2":         `{"objectId": "plan-2", "objectType": "plan"}`,
+		"version:plan-1": "3",
+		"schema:plan":    `{"objectType": "plan"}`,
+	}}
+
+	if err := BackfillPlanIndex(context.Background(), repo); err != nil {
+		t.Fatalf("BackfillPlanIndex() error = %v", err)
+	}
+	if want := []string{"plan-1", "plan-2"}; !reflect.DeepEqual(repo.index, want) {
+		t.Errorf("index = %v, want %v", repo.index, want)
+	}
+
+	repo.values["plan-3"] = `{"objectId": "plan-3", "objectType": "plan"}`
+	if err := BackfillPlanIndex(context.Background(), repo); err != nil {
+		t.Fatalf("second BackfillPlanIndex() error = %v", err)
+	}
+	if len(repo.index) != 2 {
+		t.Errorf("index = %v, want the second call to skip the scan", repo.index)
+	}
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/girish332/bigdata/indexer"
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/repository"
+	log "github.com/sirupsen/logrus"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// reindexStateKey holds the progress of the last full reindex
+	reindexStateKey = "reindex:state"
+
+	defaultReindexBatch = 100
+	// reindexStaleAfter is how long a running reindex may go without progress
+	// before it is considered dead and another one may start
+	reindexStaleAfter = time.Minute
+)
+
+const (
+	ReindexRunning   = "running"
+	ReindexCompleted = "completed"
+	ReindexFailed    = "failed"
+	ReindexCancelled = "cancelled"
+)
+
+var ErrReindexRunning = errors.New("a reindex is already running")
+
+// ReindexOptions tunes a full reindex
+type ReindexOptions struct {
+	// BatchSize is the number of plans read from Redis and indexed at a time
+	BatchSize int64 `json:"batchSize"`
+	// Rate limits the reindex to this many plans per second, 0 is unlimited
+	Rate int `json:"rate"`
+	// Resume continues after the last plan of an unfinished reindex instead of starting over
+	Resume bool `json:"resume"`
+}
+
+// ReindexState is the progress of a full reindex, persisted in Redis after every
+// batch so a reindex can be followed from any API instance and resumed after a crash
+type ReindexState struct {
+	Status  string         `json:"status"`
+	Options ReindexOptions `json:"options"`
+	// Cursor is the objectId of the last plan that was indexed
+	Cursor    string    `json:"cursor,omitempty"`
+	Total     int64     `json:"total"`
+	Indexed   int64     `json:"indexed"`
+	Failed    int64     `json:"failed"`
+	LastError string    `json:"lastError,omitempty"`
+	StartedAt time.Time `json:"startedAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ReindexService rebuilds the search index from the plans stored in Redis
+type ReindexService struct {
+	repo repository.RedisRepo
+	ix   *indexer.Indexer
+	mu   sync.Mutex
+}
+
+func NewReindexService(repo repository.RedisRepo, ix *indexer.Indexer) *ReindexService {
+	return &ReindexService{
+		repo: repo,
+		ix:   ix,
+	}
+}
+
+// State returns the progress of the last reindex, or nil if there never was one
+func (rs *ReindexService) State(ctx context.Context) (*ReindexState, error) {
+	value, err := rs.repo.Get(ctx, reindexStateKey)
+	if errors.Is(err, repository.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state ReindexState
+	err = json.Unmarshal([]byte(value), &state)
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// Start claims the reindex and runs it in the background
+func (rs *ReindexService) Start(ctx context.Context, opts ReindexOptions) (ReindexState, error) {
+	state, err := rs.begin(ctx, opts)
+	if err != nil {
+		return ReindexState{}, err
+	}
+
+	go func() {
+		_, err := rs.run(context.Background(), state)
+		if err != nil {
+			log.Errorf("Reindex failed : %v", err)
+		}
+	}()
+	return state, nil
+}
+
+// Run reindexes every plan in Redis and returns once all of them were indexed.
+// Cancelling ctx stops the reindex after the current batch; it can be resumed.
+func (rs *ReindexService) Run(ctx context.Context, opts ReindexOptions) (ReindexState, error) {
+	state, err := rs.begin(ctx, opts)
+	if err != nil {
+		return ReindexState{}, err
+	}
+	return rs.run(ctx, state)
+}
+
+// begin checks no other reindex is making progress and records the new one
+func (rs *ReindexService) begin(ctx context.Context, opts ReindexOptions) (ReindexState, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultReindexBatch
+	}
+
+	previous, err := rs.State(ctx)
+	if err != nil {
+		return ReindexState{}, err
+	}
+	if previous != nil && previous.Status == ReindexRunning && time.Since(previous.UpdatedAt) < reindexStaleAfter {
+		return ReindexState{}, ErrReindexRunning
+	}
+
+	total, err := rs.repo.ZCard(ctx, planIndexKey)
+	if err != nil {
+		return ReindexState{}, err
+	}
+
+	now := time.Now().UTC()
+	state := ReindexState{
+		Status:    ReindexRunning,
+		Options:   opts,
+		Total:     total,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	if opts.Resume && previous != nil && previous.Status != ReindexCompleted {
+		state.Cursor = previous.Cursor
+		state.Indexed = previous.Indexed
+		state.Failed = previous.Failed
+		state.StartedAt = previous.StartedAt
+	}
+
+	err = rs.save(ctx, &state)
+	if err != nil {
+		return ReindexState{}, err
+	}
+	return state, nil
+}
+
+func (rs *ReindexService) run(ctx context.Context, state ReindexState) (ReindexState, error) {
+	log.Printf("Reindexing %d plans starting after %q", state.Total, state.Cursor)
+
+	for {
+		started := time.Now()
+		ids, err := rs.repo.ZRangeAfter(ctx, planIndexKey, state.Cursor, state.Options.BatchSize)
+		if err == nil && len(ids) == 0 {
+			state.Status = ReindexCompleted
+			break
+		}
+		if err == nil {
+			err = rs.indexBatch(ctx, &state, ids)
+		}
+		if err != nil {
+			state.Status = ReindexFailed
+			if ctx.Err() != nil {
+				state.Status = ReindexCancelled
+			}
+			state.LastError = err.Error()
+			rs.save(context.Background(), &state)
+			return state, err
+		}
+
+		state.Cursor = ids[len(ids)-1]
+		err = rs.save(ctx, &state)
+		if err != nil {
+			return state, err
+		}
+		log.Printf("Reindexed %d of %d plans, %d failed", state.Indexed, state.Total, state.Failed)
+
+		// Spread the batches out so the plans per second stay below the rate
+		if state.Options.Rate > 0 {
+			budget := time.Duration(len(ids)) * time.Second / time.Duration(state.Options.Rate)
+			select {
+			case <-time.After(budget - time.Since(started)):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	err := rs.save(ctx, &state)
+	if err != nil {
+		return state, err
+	}
+	log.Printf("Reindex completed, %d plans indexed and %d failed", state.Indexed, state.Failed)
+	return state, nil
+}
+
+// indexBatch indexes the plans with the given ids at their current version.
+// Plans that fail to index are counted and skipped, a later reindex or write
+// of the plan picks them up again.
+func (rs *ReindexService) indexBatch(ctx context.Context, state *ReindexState, ids []string) error {
+	plans, versions, err := loadPlans(ctx, rs.repo, ids)
+	if err != nil {
+		return err
+	}
+
+	// Index the plans of the batch concurrently so they share _bulk requests
+	var wg sync.WaitGroup
+	errs := make([]error, len(plans))
+	for i := range plans {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = rs.ix.IndexPlan(ctx, plans[i], versions[i])
+		}(i)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	for i, err := range errs {
+		if err != nil {
+			log.Errorf("Failed to reindex plan %s : %v", plans[i].ObjectId, err)
+			state.Failed++
+			state.LastError = err.Error()
+			continue
+		}
+		state.Indexed++
+	}
+	return nil
+}
+
+func (rs *ReindexService) save(ctx context.Context, state *ReindexState) error {
+	state.UpdatedAt = time.Now().UTC()
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return rs.repo.SetPersistent(ctx, reindexStateKey, string(value))
+}
+
+// loadPlans reads the plans with the given ids along with their current version.
+// Plans that expired since the id was listed, or cannot be read, are left out.
+func loadPlans(ctx context.Context, repo repository.RedisRepo, ids []string) ([]models.Plan, []int64, error) {
+	values, err := repo.MGet(ctx, ids...)
+	if err != nil {
+		return nil, nil, err
+	}
+	versionKeys := make([]string, len(ids))
+	for i, id := range ids {
+		versionKeys[i] = versionKeyPrefix + id
+	}
+	versionValues, err := repo.MGet(ctx, versionKeys...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plans := make([]models.Plan, 0, len(ids))
+	versions := make([]int64, 0, len(ids))
+	for i, value := range values {
+		if value == "" {
+			continue
+		}
+		var plan models.Plan
+		err := json.Unmarshal([]byte(value), &plan)
+		if err != nil {
+			log.Errorf("Error unmarshalling plan %s from the redis : %v", ids[i], err)
+			continue
+		}
+
+		// Plans stored before versions were introduced start at 1
+		version := int64(1)
+		if versionValues[i] != "" {
+			version, err = strconv.ParseInt(versionValues[i], 10, 64)
+			if err != nil {
+				log.Errorf("Error parsing the version of plan %s : %v", ids[i], err)
+				continue
+			}
+		}
+		plans = append(plans, plan)
+		versions = append(versions, version)
+	}
+	return plans, versions, nil
+}
@@ -0,0 +1,214 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/repository"
+	"github.com/girish332/bigdata/schema"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+// schemaKeyPrefix namespaces the registered schemas, one key per objectType
+const schemaKeyPrefix = "schema:"
+
+var ErrSchemaNotFound = errors.New("schema not found")
+
+// SchemaError lists every schema violation of a document
+type SchemaError struct {
+	Errors []schema.ValidationError
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("document does not match its schema: %d violation(s)", len(e.Errors))
+}
+
+type SchemaService struct {
+	repo repository.RedisRepo
+}
+
+func NewSchemaService(repo repository.RedisRepo) *SchemaService {
+	return &SchemaService{
+		repo: repo,
+	}
+}
+
+// SaveSchema registers the schema for an objectType after checking that it compiles
+func (ss *SchemaService) SaveSchema(c *gin.Context, objectType string, raw []byte) error {
+	if _, err := schema.Compile(raw); err != nil {
+		return err
+	}
+
+	err := ss.repo.SetPersistent(c, schemaKeyPrefix+objectType, string(raw))
+	if err != nil {
+		log.Printf("Error saving the schema in the redis : %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetSchema returns the registered schema for an objectType, or the built in one
+func (ss *SchemaService) GetSchema(c *gin.Context, objectType string) ([]byte, error) {
+	value, err := ss.repo.Get(c, schemaKeyPrefix+objectType)
+	if errors.Is(err, repository.ErrKeyNotFound) {
+		if raw, ok := schema.Default(objectType); ok {
+			return raw, nil
+		}
+		return nil, ErrSchemaNotFound
+	}
+	if err != nil {
+		log.Printf("Error getting the schema from the redis : %v", err)
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// position is a place in the plan graph and the objectType of the objects held
+// there. Array members share the position of their items.
+type position struct {
+	objectType string
+	members    map[string]position
+}
+
+// planLayout is the shape of a plan, used to pick the schema of every object
+// from where it sits instead of the objectType it claims
+var planLayout = position{
+	objectType: "plan",
+	members: map[string]position{
+		"planCostShares": {objectType: "membercostshare"},
+		"linkedPlanServices": {
+			objectType: "planservice",
+			members: map[string]position{
+				"linkedService":         {objectType: "service"},
+				"planserviceCostShares": {objectType: "membercostshare"},
+			},
+		},
+	},
+}
+
+// Validate checks a plan document against the plan schema. Every nested object
+// at a known position is also checked against the registered schema of the
+// objectType of that position, when there is one. An objectType that differs
+// from the one of its position, or is set on an object anywhere else, is a
+// violation, as is an objectId starting with a reserved key prefix or used by
+// another object of the plan. A *SchemaError is returned when the document does
+// not match.
+func (ss *SchemaService) Validate(c *gin.Context, doc []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(doc, &value); err != nil {
+		return &SchemaError{Errors: []schema.ValidationError{{Pointer: "", Message: "is not valid JSON: " + err.Error()}}}
+	}
+
+	compiled := make(map[string]*schema.Schema)
+	// objectIds holds where every objectId was first used, as every object of a
+	// plan is stored under its own objectId
+	objectIds := make(map[string]string)
+	seen := make(map[schema.ValidationError]bool)
+	violations := make([]schema.ValidationError, 0)
+	report := func(found []schema.ValidationError) {
+		for _, violation := range found {
+			if !seen[violation] {
+				seen[violation] = true
+				violations = append(violations, violation)
+			}
+		}
+	}
+
+	var walk func(node interface{}, at *position, pointer string) error
+	walk = func(node interface{}, at *position, pointer string) error {
+		switch node := node.(type) {
+		case map[string]interface{}:
+			if claimed, ok := node["objectType"]; ok {
+				switch {
+				case at == nil:
+					report([]schema.ValidationError{{Pointer: pointer + "/objectType", Message: "is not allowed outside of the plan objects"}})
+				case claimed != at.objectType:
+					report([]schema.ValidationError{{Pointer: pointer + "/objectType", Message: fmt.Sprintf("must be %q", at.objectType)}})
+				}
+			}
+			if objectId, ok := node["objectId"].(string); ok && at != nil {
+				if prefix, reserved := reservedPrefix(objectId); reserved {
+					report([]schema.ValidationError{{Pointer: pointer + "/objectId", Message: fmt.Sprintf("must not start with the reserved prefix %q", prefix)}})
+				}
+				if first, ok := objectIds[objectId]; ok {
+					report([]schema.ValidationError{{Pointer: pointer + "/objectId", Message: fmt.Sprintf("duplicates the objectId at %s", first)}})
+				} else {
+					objectIds[objectId] = pointer + "/objectId"
+				}
+			}
+			if at != nil {
+				s, err := ss.compiledSchema(c, compiled, at.objectType)
+				if err != nil {
+					return err
+				}
+				if s != nil {
+					report(s.Validate(node, pointer))
+				}
+			}
+			// Members are walked in a fixed order so the same object of a
+			// duplicated objectId is always the one reported
+			names := make([]string, 0, len(node))
+			for name := range node {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				member := node[name]
+				var next *position
+				if at != nil {
+					if p, ok := at.members[name]; ok {
+						next = &p
+					}
+				}
+				if err := walk(member, next, pointer+"/"+schema.EscapePointer(name)); err != nil {
+					return err
+				}
+			}
+		case []interface{}:
+			for i, item := range node {
+				if err := walk(item, at, fmt.Sprintf("%s/%d", pointer, i)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	if err := walk(value, &planLayout, ""); err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		sort.SliceStable(violations, func(i, j int) bool {
+			return violations[i].Pointer < violations[j].Pointer
+		})
+		return &SchemaError{Errors: violations}
+	}
+	return nil
+}
+
+// compiledSchema compiles the schema of an objectType once per validation.
+// It returns nil when no schema exists for the objectType, whose objects are
+// then only checked by the plan schema.
+func (ss *SchemaService) compiledSchema(c *gin.Context, compiled map[string]*schema.Schema, objectType string) (*schema.Schema, error) {
+	if s, ok := compiled[objectType]; ok {
+		return s, nil
+	}
+
+	raw, err := ss.GetSchema(c, objectType)
+	if errors.Is(err, ErrSchemaNotFound) {
+		compiled[objectType] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := schema.Compile(raw)
+	if err != nil {
+		return nil, err
+	}
+	compiled[objectType] = s
+	return s, nil
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/girish332/bigdata/outbox"
+	"github.com/girish332/bigdata/repository"
+	"github.com/girish332/bigdata/schema"
+)
+
+// schemasRepo serves registered schemas through Get
+type schemasRepo struct {
+	repository.RedisRepo
+	values map[string]string
+}
+
+func (r schemasRepo) Get(_ context.Context, key string) (string, error) {
+	value, ok := r.values[key]
+	if !ok {
+		return "", repository.ErrKeyNotFound
+	}
+	return value, nil
+}
+
+const validPlan = `{
+	"planCostShares": {"deductible": 2000, "_org": "example.com", "copay": 23, "objectId": "pcs-1", "objectType": "membercostshare"},
+	"linkedPlanServices": [{
+		"linkedService": {"_org": "example.com", "objectId": "ls-1", "objectType": "service", "name": "Yearly physical"},
+		"planserviceCostShares": {"deductible": 10, "_org": "example.com", "copay": 0, "objectId": "pscs-1", "objectType": "membercostshare"},
+		"_org": "example.com", "objectId": "lps-1", "objectType": "planservice"
+	}],
+	"_org": "example.com", "objectId": "plan-1", "objectType": "plan", "planType": "inNetwork", "creationDate": "12-12-2017"
+}`
+
+func TestValidatePicksSchemasByPosition(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ss := NewSchemaService(schemasRepo{values: map[string]string{
+		// A registered schema for services is applied to linkedService
+		schemaKeyPrefix + "service": `{"properties": {"name": {"maxLength": 10}}}`,
+	}})
+
+	if err := ss.Validate(c, []byte(strings.Replace(validPlan, "Yearly physical", "Physical", 1))); err != nil {
+		t.Fatalf("Validate() of a valid plan error = %v", err)
+	}
+
+	tests := map[string]struct {
+		from, to string
+		want     []schema.ValidationError
+	}{
+		"registered child schema": {
+			from: "Physical", to: "Yearly physical",
+			want: []schema.ValidationError{{Pointer: "/linkedPlanServices/0/linkedService/name", Message: "must be at most 10 characters long"}},
+		},
+		"unknown objectType": {
+			from: `"objectType": "service"`, to: `"objectType": "x"`,
+			want: []schema.ValidationError{{Pointer: "/linkedPlanServices/0/linkedService/objectType", Message: `must be "service"`}},
+		},
+		"reserved objectId": {
+			from: `"objectId": "ls-1"`, to: `"objectId": "schema:plan"`,
+			want: []schema.ValidationError{{Pointer: "/linkedPlanServices/0/linkedService/objectId", Message: `must not start with the reserved prefix "schema:"`}},
+		},
+		"objectType of another position": {
+			from: `"objectType": "plan"`, to: `"objectType": "service"`,
+			want: []schema.ValidationError{{Pointer: "/objectType", Message: `must be "plan"`}},
+		},
+	}
+	for name, tt := range tests {
+		doc := strings.Replace(validPlan, "Yearly physical", "Physical", 1)
+		doc = strings.Replace(doc, tt.from, tt.to, 1)
+		err := ss.Validate(c, []byte(doc))
+		var schemaErr *SchemaError
+		if !errors.As(err, &schemaErr) {
+			t.Errorf("%s: Validate() error = %v, want a SchemaError", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(schemaErr.Errors, tt.want) {
+			t.Errorf("%s: Validate() errors = %v, want %v", name, schemaErr.Errors, tt.want)
+		}
+	}
+}
+
+func TestValidateRejectsDuplicateObjectIds(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	ss := NewSchemaService(schemasRepo{values: map[string]string{}})
+
+	var plan map[string]interface{}
+	if err := json.Unmarshal([]byte(validPlan), &plan); err != nil {
+		t.Fatal(err)
+	}
+	services := plan["linkedPlanServices"].([]interface{})
+	plan["linkedPlanServices"] = append(services, services[0])
+	twice, _ := json.Marshal(plan)
+
+	tests := map[string]struct {
+		doc  string
+		want []schema.ValidationError
+	}{
+		"child reusing the plan objectId": {
+			doc:  strings.Replace(validPlan, `"objectId": "pcs-1"`, `"objectId": "plan-1"`, 1),
+			want: []schema.ValidationError{{Pointer: "/planCostShares/objectId", Message: "duplicates the objectId at /objectId"}},
+		},
+		"linked plan service listed twice": {
+			doc: string(twice),
+			want: []schema.ValidationError{
+				{Pointer: "/linkedPlanServices/1/linkedService/objectId", Message: "duplicates the objectId at /linkedPlanServices/0/linkedService/objectId"},
+				{Pointer: "/linkedPlanServices/1/objectId", Message: "duplicates the objectId at /linkedPlanServices/0/objectId"},
+				{Pointer: "/linkedPlanServices/1/planserviceCostShares/objectId", Message: "duplicates the objectId at /linkedPlanServices/0/planserviceCostShares/objectId"},
+			},
+		},
+	}
+	for name, tt := range tests {
+		err := ss.Validate(c, []byte(tt.doc))
+		var schemaErr *SchemaError
+		if !errors.As(err, &schemaErr) {
+			t.Errorf("%s: Validate() error = %v, want a SchemaError", name, err)
+			continue
+		}
+		if !reflect.DeepEqual(schemaErr.Errors, tt.want) {
+			t.Errorf("%s: Validate() errors = %v, want %v", name, schemaErr.Errors, tt.want)
+		}
+	}
+}
+
+func TestReservedPrefixCoversEveryServiceKey(t *testing.T) {
+	for _, key := range []string{planIndexKey, versionKeyPrefix + "plan-1", schemaKeyPrefix + "plan", reindexStateKey, outbox.Key} {
+		if _, ok := reservedPrefix(key); !ok {
+			t.Errorf("reservedPrefix(%q) = false, want true", key)
+		}
+	}
+	for _, objectId := range []string{"plan-1", "plans-1", "12xvxc345ssdsds-508"} {
+		if prefix, ok := reservedPrefix(objectId); ok {
+			t.Errorf("reservedPrefix(%q) = %q, want none", objectId, prefix)
+		}
+	}
+}
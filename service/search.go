@@ -0,0 +1,412 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/elastic/go-elasticsearch/v8"
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+	"github.com/girish332/bigdata/elastic"
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/repository"
+	"github.com/girish332/bigdata/search"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// SearchHit is a document matched by a search
+type SearchHit struct {
+	ID string `json:"id"`
+	// PlanId is the root plan of the document, its routing in the index
+	PlanId string `json:"planId"`
+	// Score is left out when the hits are sorted by a field
+	Score    *float64               `json:"score,omitempty"`
+	Document map[string]interface{} `json:"document"`
+	// Related are the inner hits of a relationship search, keyed by the relation
+	// of the related documents
+	Related map[string][]SearchHit `json:"related,omitempty"`
+}
+
+// SearchResult is a page of hits along with the number of documents matched
+type SearchResult struct {
+	Total int64       `json:"total"`
+	From  int         `json:"from"`
+	Size  int         `json:"size"`
+	Hits  []SearchHit `json:"hits"`
+	// Next is the cursor of the following page of a paginate=cursor search, empty
+	// on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// ResolvedPlan is a plan matched by a search through any of its documents
+type ResolvedPlan struct {
+	Plan models.Plan `json:"plan"`
+	// Score is the best score of the hits in the plan
+	Score *float64 `json:"score,omitempty"`
+	// Matches are JSON Pointers to the matched objects in the plan, "" for the
+	// plan itself
+	Matches []string `json:"matches"`
+}
+
+// PlanSearchResult is a page of hits resolved to the plans they belong to. Total,
+// From and Size still count documents, so a page holds at most Size plans.
+// Plans are merged within a page only: a plan with hits on two pages is
+// returned on both.
+type PlanSearchResult struct {
+	Total int64 `json:"total"`
+	From  int   `json:"from"`
+	Size  int   `json:"size"`
+	// Hits is the number of document hits on the page the plans were resolved from
+	Hits  int            `json:"hits"`
+	Plans []ResolvedPlan `json:"plans"`
+	Next  string         `json:"next,omitempty"`
+}
+
+// SearchService runs structured searches against the plans index
+type SearchService struct {
+	repo   repository.RedisRepo
+	es     *elasticsearch.Client
+	index  string
+	fields search.Fields
+	join   search.Join
+}
+
+// NewSearchService searches index, allowing the fields of mapping in queries, and
+// resolves hits to the plans stored in repo
+func NewSearchService(repo repository.RedisRepo, es *elasticsearch.Client, index string, mapping map[string]interface{}) *SearchService {
+	return &SearchService{
+		repo:   repo,
+		es:     es,
+		index:  index,
+		fields: search.NewFields(mapping),
+		join:   search.NewJoin(mapping),
+	}
+}
+
+type searchResponse struct {
+	PitID string `json:"pit_id"`
+	Hits  struct {
+		Total struct {
+			Value int64 `json:"value"`
+		} `json:"total"`
+		Hits []searchResponseHit `json:"hits"`
+	} `json:"hits"`
+}
+
+type searchResponseHit struct {
+	ID        string                 `json:"_id"`
+	Routing   string                 `json:"_routing"`
+	Score     *float64               `json:"_score"`
+	Source    map[string]interface{} `json:"_source"`
+	Sort      []json.RawMessage      `json:"sort"`
+	InnerHits map[string]struct {
+		Hits struct {
+			Hits []searchResponseHit `json:"hits"`
+		} `json:"hits"`
+	} `json:"inner_hits"`
+}
+
+// Search validates req and runs it. Invalid requests fail with
+// search.ErrInvalidQuery before anything is sent to Elasticsearch. With
+// paginate=cursor the first page is read from a new point in time.
+func (ss *SearchService) Search(ctx context.Context, req search.Request) (SearchResult, error) {
+	if req.Paginate == search.PaginateCursor {
+		return ss.startCursor(ctx, req)
+	}
+
+	body, err := req.Build(ss.fields)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return ss.search(ctx, body)
+}
+
+// Next reads the page after the one that returned the next token. All pages of
+// a cursor see the index as it was when the search started, however it changes
+// in between, as long as each page is read within search.KeepAlive of the last.
+func (ss *SearchService) Next(ctx context.Context, token string) (SearchResult, error) {
+	cursor, err := search.DecodeCursor(token)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return ss.page(ctx, cursor)
+}
+
+func (ss *SearchService) startCursor(ctx context.Context, req search.Request) (SearchResult, error) {
+	// Validate before opening a point in time that would otherwise be left open
+	_, err := search.Cursor{Request: req}.Page(ss.fields)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	var pit struct {
+		ID string `json:"id"`
+	}
+	res, err := esapi.OpenPointInTimeRequest{
+		Index:     []string{ss.index},
+		KeepAlive: search.KeepAlive,
+	}.Do(ctx, ss.es)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	err = elastic.DecodeResponse(res, &pit)
+	if err != nil {
+		return SearchResult{}, fmt.Errorf("failed to open a point in time: %w", err)
+	}
+	return ss.page(ctx, search.Cursor{Request: req, PIT: pit.ID})
+}
+
+// page reads the page of a cursor. A full page returns the cursor of the next
+// one, the last page closes the point in time.
+func (ss *SearchService) page(ctx context.Context, cursor search.Cursor) (SearchResult, error) {
+	body, err := cursor.Page(ss.fields)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	body["track_total_hits"] = true
+
+	var response searchResponse
+	err = ss.do(ctx, body, &response)
+	var resErr *elastic.ResponseError
+	if errors.As(err, &resErr) && resErr.StatusCode == http.StatusNotFound {
+		return SearchResult{}, fmt.Errorf("%w: the cursor expired, start the search again", search.ErrInvalidQuery)
+	}
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	size := body["size"].(int)
+	result := SearchResult{
+		Total: response.Hits.Total.Value,
+		Size:  size,
+		Hits:  searchHits(response.Hits.Hits, ""),
+	}
+	hits := response.Hits.Hits
+	if len(hits) < size {
+		ss.closePIT(response.PitID)
+		return result, nil
+	}
+
+	// The point in time id may change from page to page
+	next := search.Cursor{Request: cursor.Request, PIT: response.PitID, After: hits[len(hits)-1].Sort}
+	if next.PIT == "" {
+		next.PIT = cursor.PIT
+	}
+	result.Next, err = next.Encode()
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return result, nil
+}
+
+func (ss *SearchService) closePIT(id string) {
+	if id == "" {
+		return
+	}
+	raw, _ := json.Marshal(map[string]string{"id": id})
+	res, err := esapi.ClosePointInTimeRequest{Body: bytes.NewReader(raw)}.Do(context.Background(), ss.es)
+	if err != nil {
+		log.Printf("Failed to close a point in time : %v", err)
+		return
+	}
+	res.Body.Close()
+}
+
+// HasChild finds documents by their children, for example the plans having a
+// service whose planserviceCostShares have a copay below some amount
+func (ss *SearchService) HasChild(ctx context.Context, req search.RelationRequest) (SearchResult, error) {
+	body, err := req.HasChild(ss.fields, ss.join)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return ss.search(ctx, body)
+}
+
+// HasParent finds documents by their parents, for example the services of plans
+// of some planType
+func (ss *SearchService) HasParent(ctx context.Context, req search.RelationRequest) (SearchResult, error) {
+	body, err := req.HasParent(ss.fields, ss.join)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	return ss.search(ctx, body)
+}
+
+func (ss *SearchService) search(ctx context.Context, body map[string]interface{}) (SearchResult, error) {
+	body["track_total_hits"] = true
+
+	var response searchResponse
+	err := ss.do(ctx, body, &response)
+	if err != nil {
+		return SearchResult{}, err
+	}
+
+	return SearchResult{
+		Total: response.Hits.Total.Value,
+		From:  body["from"].(int),
+		Size:  body["size"].(int),
+		Hits:  searchHits(response.Hits.Hits, ""),
+	}, nil
+}
+
+// searchHits converts the hits of a response along with their inner hits. Inner
+// hits belong to the plan of the hit they are nested in.
+func searchHits(hits []searchResponseHit, planId string) []SearchHit {
+	result := make([]SearchHit, 0, len(hits))
+	for _, hit := range hits {
+		searchHit := SearchHit{
+			ID:       hit.ID,
+			PlanId:   hit.Routing,
+			Score:    hit.Score,
+			Document: hit.Source,
+		}
+		if searchHit.PlanId == "" {
+			searchHit.PlanId = planId
+		}
+		for relation, inner := range hit.InnerHits {
+			if searchHit.Related == nil {
+				searchHit.Related = make(map[string][]SearchHit)
+			}
+			searchHit.Related[relation] = searchHits(inner.Hits.Hits, searchHit.PlanId)
+		}
+		result = append(result, searchHit)
+	}
+	return result
+}
+
+// Resolve replaces the hits of a search with the plans they belong to, loaded
+// from Redis. Plans keep the order of their first hit and hits of the same plan,
+// along with their related hits, are merged into one entry, within this page
+// only. Plans that are no longer in Redis are left out.
+func (ss *SearchService) Resolve(ctx context.Context, result SearchResult) (PlanSearchResult, error) {
+	resolved := PlanSearchResult{
+		Total: result.Total,
+		From:  result.From,
+		Size:  result.Size,
+		Hits:  len(result.Hits),
+		Plans: make([]ResolvedPlan, 0),
+		Next:  result.Next,
+	}
+
+	ids := make([]string, 0)
+	matches := make(map[string][]SearchHit)
+	for _, hit := range result.Hits {
+		if _, ok := matches[hit.PlanId]; !ok {
+			ids = append(ids, hit.PlanId)
+		}
+		matches[hit.PlanId] = append(matches[hit.PlanId], hit)
+	}
+	if len(ids) == 0 {
+		return resolved, nil
+	}
+
+	plans, _, err := loadPlans(ctx, ss.repo, ids)
+	if err != nil {
+		return resolved, err
+	}
+	for _, plan := range plans {
+		paths := planPaths(plan)
+		entry := ResolvedPlan{Plan: plan, Matches: make([]string, 0)}
+		seen := make(map[string]bool)
+		var add func(hits []SearchHit)
+		add = func(hits []SearchHit) {
+			for _, hit := range hits {
+				path, ok := paths[hit.ID]
+				if ok && !seen[path] {
+					seen[path] = true
+					entry.Matches = append(entry.Matches, path)
+				}
+				for _, related := range hit.Related {
+					add(related)
+				}
+			}
+		}
+		for _, hit := range matches[plan.ObjectId] {
+			if hit.Score != nil && (entry.Score == nil || *hit.Score > *entry.Score) {
+				entry.Score = hit.Score
+			}
+		}
+		add(matches[plan.ObjectId])
+		sort.Strings(entry.Matches)
+		resolved.Plans = append(resolved.Plans, entry)
+	}
+	return resolved, nil
+}
+
+// planPaths maps the objectId of every object of a plan to its JSON Pointer
+func planPaths(plan models.Plan) map[string]string {
+	paths := map[string]string{
+		plan.ObjectId:                "",
+		plan.PlanCostShares.ObjectId: "/planCostShares",
+	}
+	for i, linkedPlanService := range plan.LinkedPlanServices {
+		pointer := "/linkedPlanServices/" + strconv.Itoa(i)
+		paths[linkedPlanService.ObjectId] = pointer
+		paths[linkedPlanService.LinkedService.ObjectId] = pointer + "/linkedService"
+		paths[linkedPlanService.PlanServiceCostShares.ObjectId] = pointer + "/planserviceCostShares"
+	}
+	return paths
+}
+
+// Analytics validates req and runs its aggregations, returning them flattened
+// to a table
+func (ss *SearchService) Analytics(ctx context.Context, req search.AnalyticsRequest) (search.Table, error) {
+	body, err := req.Build(ss.fields, ss.join)
+	if err != nil {
+		return search.Table{}, err
+	}
+
+	var response struct {
+		Aggregations json.RawMessage `json:"aggregations"`
+	}
+	err = ss.do(ctx, body, &response)
+	if err != nil {
+		return search.Table{}, err
+	}
+	return req.Table(response.Aggregations)
+}
+
+// SuggestServices completes the name of a linked service, returning the distinct
+// names that match the text typed so far with the number of plans using each
+func (ss *SearchService) SuggestServices(ctx context.Context, text string, size int) ([]search.Suggestion, error) {
+	suggest := search.Suggest{Type: elastic.JoinLinkedService, Field: "name", Text: text, Size: size}
+	body, err := suggest.Build(ss.fields, ss.join)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Aggregations json.RawMessage `json:"aggregations"`
+	}
+	err = ss.do(ctx, body, &response)
+	if err != nil {
+		return nil, err
+	}
+	return suggest.Suggestions(response.Aggregations)
+}
+
+// do sends a search body and decodes the response into out. Searches of a point
+// in time name no index, the point in time already belongs to one.
+func (ss *SearchService) do(ctx context.Context, body map[string]interface{}, out interface{}) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req := esapi.SearchRequest{Body: bytes.NewReader(raw)}
+	if _, ok := body["pit"]; !ok {
+		req.Index = []string{ss.index}
+	}
+	res, err := req.Do(ctx, ss.es)
+	if err != nil {
+		return err
+	}
+	err = elastic.DecodeResponse(res, out)
+	if err != nil {
+		return fmt.Errorf("search failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/girish332/bigdata/models"
+	"github.com/girish332/bigdata/repository"
+)
+
+// plansRepo serves plans through MGet, the only read Resolve makes
+type plansRepo struct {
+	repository.RedisRepo
+	values map[string]string
+}
+
+func (r plansRepo) MGet(_ context.Context, keys ...string) ([]string, error) {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = r.values[key]
+	}
+	return values, nil
+}
+
+func TestResolveMergesHitsByPlan(t *testing.T) {
+	plan := models.Plan{
+		PlanCostShares: models.PlanCostShares{ObjectId: "pcs-1"},
+		LinkedPlanServices: []models.LinkedPlanService{
+			{ObjectId: "lps-1", LinkedService: models.LinkedService{ObjectId: "ls-1"}, PlanServiceCostShares: models.PlanServiceCostShares{ObjectId: "pscs-1"}},
+			{ObjectId: "lps-2", LinkedService: models.LinkedService{ObjectId: "ls-2"}, PlanServiceCostShares: models.PlanServiceCostShares{ObjectId: "pscs-2"}},
+		},
+		ObjectId: "plan-1",
+	}
+	raw, _ := json.Marshal(plan)
+	ss := &SearchService{repo: plansRepo{values: map[string]string{"plan-1": string(raw)}}}
+
+	low, high := 0.5, 2.0
+	result := SearchResult{
+		Total: 4,
+		Size:  20,
+		Hits: []SearchHit{
+			{ID: "pscs-2", PlanId: "plan-1", Score: &low},
+			// Deleted from Redis but still indexed
+			{ID: "plan-2", PlanId: "plan-2", Score: &high},
+			{ID: "lps-1", PlanId: "plan-1", Score: &high, Related: map[string][]SearchHit{
+				"planserviceCostShares": {{ID: "pscs-1", PlanId: "plan-1"}},
+			}},
+			{ID: "pscs-2", PlanId: "plan-1", Score: &low},
+		},
+	}
+
+	resolved, err := ss.Resolve(context.Background(), result)
+	if err != nil {
+		t.Fatalf("Resolve() error = %v", err)
+	}
+	if len(resolved.Plans) != 1 || resolved.Total != 4 {
+		t.Fatalf("Resolve() = %+v, want only plan-1 with the total of the search", resolved)
+	}
+	got := resolved.Plans[0]
+	want := []string{"/linkedPlanServices/0", "/linkedPlanServices/0/planserviceCostShares", "/linkedPlanServices/1/planserviceCostShares"}
+	if got.Plan.ObjectId != "plan-1" || !reflect.DeepEqual(got.Matches, want) {
+		t.Errorf("Resolve() plan %s matches %v, want plan-1 matching %v", got.Plan.ObjectId, got.Matches, want)
+	}
+	if got.Score == nil || *got.Score != high {
+		t.Errorf("Resolve() score = %v, want the best hit score %v", got.Score, high)
+	}
+}
+
+func TestResolveMergesWithinAPageOnly(t *testing.T) {
+	values := map[string]string{}
+	for _, objectId := range []string{"plan-1", "plan-2"} {
+		raw, _ := json.Marshal(models.Plan{ObjectId: objectId, PlanCostShares: models.PlanCostShares{ObjectId: objectId + "-pcs"}})
+		values[objectId] = string(raw)
+	}
+	ss := &SearchService{repo: plansRepo{values: values}}
+
+	// plan-1 has one hit on each of two pages of size 2
+	pages := []SearchResult{
+		{Total: 4, From: 0, Size: 2, Hits: []SearchHit{{ID: "plan-1", PlanId: "plan-1"}, {ID: "plan-2", PlanId: "plan-2"}}},
+		{Total: 4, From: 2, Size: 2, Hits: []SearchHit{{ID: "plan-2-pcs", PlanId: "plan-2"}, {ID: "plan-1-pcs", PlanId: "plan-1"}}},
+	}
+	want := [][]string{{"plan-1", "plan-2"}, {"plan-2", "plan-1"}}
+	for i, page := range pages {
+		resolved, err := ss.Resolve(context.Background(), page)
+		if err != nil {
+			t.Fatalf("page %d: Resolve() error = %v", i, err)
+		}
+		ids := make([]string, 0)
+		for _, plan := range resolved.Plans {
+			ids = append(ids, plan.Plan.ObjectId)
+		}
+		if !reflect.DeepEqual(ids, want[i]) || resolved.Hits != 2 || resolved.From != page.From {
+			t.Errorf("page %d: Resolve() = plans %v from %d hits at %d, want plans %v from 2 hits at %d",
+				i, ids, resolved.Hits, resolved.From, want[i], page.From)
+		}
+	}
+}